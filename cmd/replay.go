@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"ntcb-server/simulator"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay <session file>...",
+	Short: "Replay recorded device sessions",
+	Long: `Replay sends the data received from the devices in the recorded sessions to a NTCB server,
+sessions are replayed concurrently. Without the server address sessions are decoded and printed`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		address := viper.GetString("replay.address")
+		speed := viper.GetFloat64("replay.speed")
+
+		if address == "" {
+			for _, name := range args {
+				if err := decodeSession(name, speed); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		errs := make(chan error, len(args))
+		for _, name := range args {
+			go func(name string) {
+				errs <- replaySession(ctx, address, name, speed)
+			}(name)
+		}
+
+		var err error
+		for range args {
+			if e := <-errs; e != nil {
+				err = e
+			}
+		}
+
+		return err
+	},
+}
+
+func decodeSession(name string, speed float64) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Printf("session %s\n", name)
+
+	return simulator.Decode(os.Stdout, f, speed)
+}
+
+func replaySession(ctx context.Context, address string, name string, speed float64) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := simulator.Replay(ctx, address, f, speed)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	fmt.Printf("session %s replayed, sent=%d received=%d\n", name, r.Sent, r.Received)
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().String("address", "", "a server address, sessions are decoded and printed if empty")
+	replayCmd.Flags().Float64("speed", 1, "a replay speed factor, 0 replays without delays")
+
+	_ = viper.BindPFlag("replay.address", replayCmd.Flags().Lookup("address"))
+	_ = viper.BindPFlag("replay.speed", replayCmd.Flags().Lookup("speed"))
+}
@@ -16,10 +16,14 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"ntcb-server/server"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
@@ -32,12 +36,15 @@ var rootCmd = &cobra.Command{
 	Use:   "ntcb-server",
 	Short: "A NTCB server",
 	Long: `Server is capable of communicating with tracking devices,
-which support protocol flex 1.0`,
+which support protocol flex 1.0 or 2.0`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
 	Run: func(cmd *cobra.Command, args []string) {
-		server.ListenAndServe()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		server.ListenAndServe(ctx)
 	},
 }
 
@@ -67,15 +74,75 @@ func init() {
 	rootCmd.PersistentFlags().Int32("port", 11000, "a server port")
 	rootCmd.PersistentFlags().Bool("debug", false, "is debug mode enabled")
 	rootCmd.PersistentFlags().String("log-level", "info", "a log level: trace, debug, info, warn, error")
-	rootCmd.PersistentFlags().String("dsn", "", "a valid DSN e.g. clickhouse://localhost:8123/db?debug=true")
+	rootCmd.PersistentFlags().String("tls-cert", "", "a TLS certificate file of the device listener, TLS is disabled if empty")
+	rootCmd.PersistentFlags().String("tls-key", "", "a TLS key file of the device listener")
+	rootCmd.PersistentFlags().String("tls-client-ca", "", "a CA file to verify device certificates, which common name must be the device IMEI")
+	rootCmd.Flags().String("dsn", "", "a valid DSN e.g. clickhouse://localhost:8123/db?debug=true")
+	rootCmd.PersistentFlags().Duration("current-state-poll-interval", 0, "an interval of device current state requests, 0 disables polling")
+	rootCmd.Flags().String("ack-policy", "receive", "when telemetry is acknowledged: receive or persist, unsaved telemetry is resent by the device with persist")
+	rootCmd.Flags().Duration("idle-timeout", 0, "a duration without data after which a device is reported idle, 0 disables the check")
+	rootCmd.Flags().Duration("read-timeout", 10*time.Minute, "a duration without data after which a device connection is closed, 0 disables the check")
+	rootCmd.Flags().Duration("ping-timeout", 0, "a duration without pings after which a pinging device connection is closed, 0 disables the check")
+	rootCmd.Flags().Duration("tcp-keepalive", 0, "a TCP keep-alive period, 0 keeps the system default, negative disables keep-alive")
+	rootCmd.Flags().String("duplicate-policy", "replace", "what to do when a connected device connects again: replace, reject or allow")
+	rootCmd.Flags().Duration("shutdown-timeout", 30*time.Second, "a time to finish in-flight frames and flush telemetry on shutdown")
+	rootCmd.Flags().Bool("resync", false, "skip unknown bytes of the device stream instead of closing the connection")
+	rootCmd.Flags().Int("max-garbage-bytes", 4096, "a number of bytes skipped in a row, which closes the connection in resync mode, 0 means no limit")
+	rootCmd.Flags().String("session-dir", "", "a directory to record raw device sessions to, empty disables recording")
+	rootCmd.Flags().Bool("proxy-protocol", false, "require the PROXY protocol v1 or v2 header on connections from trusted networks")
+	rootCmd.Flags().StringSlice("proxy-trusted-nets", nil, "CIDRs of load balancers sending the PROXY protocol header, required with --proxy-protocol")
+	rootCmd.Flags().Int("max-conns", 0, "a maximum number of device connections, 0 means no limit")
+	rootCmd.Flags().Int("max-conns-per-ip", 0, "a maximum number of connections from an IP, 0 means no limit")
+	rootCmd.Flags().Float64("handshake-rate", 0, "a number of handshakes per second allowed from an IP, 0 means no limit")
+	rootCmd.Flags().Int("handshake-burst", 10, "a number of handshakes an IP may make at once within the handshake rate")
+	rootCmd.Flags().Int("ban-threshold", 0, "a number of failed handshakes or malformed frames which bans an IP, 0 disables bans")
+	rootCmd.Flags().Duration("ban-duration", 10*time.Minute, "a duration of an IP ban")
+	rootCmd.Flags().Bool("registered-devices-only", false, "allow only the devices present in the device table")
+	rootCmd.Flags().StringSlice("debug-devices", nil, "IDs of the devices which data exchange is logged, it is reloaded with the config file")
+	rootCmd.Flags().String("metrics-address", "", "an address to serve Prometheus metrics on at /metrics e.g. 0.0.0.0:9110, empty disables metrics")
+	rootCmd.Flags().Int("workers", 32, "a number of workers saving the telemetry, the telemetry of a device is saved by the same worker in order")
+	rootCmd.Flags().Int("queue-size", 128, "a number of telemetry messages queued for a worker")
+	rootCmd.Flags().String("backpressure", "block", "what to do when the queue of a worker is full: block, drop-oldest or spill")
+	rootCmd.Flags().String("spill-dir", "", "a directory to spill the telemetry exceeding the queues to, empty means the temporary directory")
+	rootCmd.Flags().Int("spill-limit", 65536, "a number of telemetry messages a worker may spill, the devices of the worker are blocked beyond it")
 
 	_ = rootCmd.MarkFlagRequired("dsn")
 
-	_ = viper.BindPFlag("dsn", rootCmd.PersistentFlags().Lookup("dsn"))
+	_ = viper.BindPFlag("dsn", rootCmd.Flags().Lookup("dsn"))
 	_ = viper.BindPFlag("host", rootCmd.PersistentFlags().Lookup("host"))
 	_ = viper.BindPFlag("port", rootCmd.PersistentFlags().Lookup("port"))
 	_ = viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
 	_ = viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	_ = viper.BindPFlag("tls-cert", rootCmd.PersistentFlags().Lookup("tls-cert"))
+	_ = viper.BindPFlag("tls-key", rootCmd.PersistentFlags().Lookup("tls-key"))
+	_ = viper.BindPFlag("tls-client-ca", rootCmd.PersistentFlags().Lookup("tls-client-ca"))
+	_ = viper.BindPFlag("current-state-poll-interval", rootCmd.PersistentFlags().Lookup("current-state-poll-interval"))
+	_ = viper.BindPFlag("ack-policy", rootCmd.Flags().Lookup("ack-policy"))
+	_ = viper.BindPFlag("idle-timeout", rootCmd.Flags().Lookup("idle-timeout"))
+	_ = viper.BindPFlag("read-timeout", rootCmd.Flags().Lookup("read-timeout"))
+	_ = viper.BindPFlag("ping-timeout", rootCmd.Flags().Lookup("ping-timeout"))
+	_ = viper.BindPFlag("tcp-keepalive", rootCmd.Flags().Lookup("tcp-keepalive"))
+	_ = viper.BindPFlag("duplicate-policy", rootCmd.Flags().Lookup("duplicate-policy"))
+	_ = viper.BindPFlag("shutdown-timeout", rootCmd.Flags().Lookup("shutdown-timeout"))
+	_ = viper.BindPFlag("resync", rootCmd.Flags().Lookup("resync"))
+	_ = viper.BindPFlag("max-garbage-bytes", rootCmd.Flags().Lookup("max-garbage-bytes"))
+	_ = viper.BindPFlag("session-dir", rootCmd.Flags().Lookup("session-dir"))
+	_ = viper.BindPFlag("proxy-protocol", rootCmd.Flags().Lookup("proxy-protocol"))
+	_ = viper.BindPFlag("proxy-trusted-nets", rootCmd.Flags().Lookup("proxy-trusted-nets"))
+	_ = viper.BindPFlag("max-conns", rootCmd.Flags().Lookup("max-conns"))
+	_ = viper.BindPFlag("max-conns-per-ip", rootCmd.Flags().Lookup("max-conns-per-ip"))
+	_ = viper.BindPFlag("handshake-rate", rootCmd.Flags().Lookup("handshake-rate"))
+	_ = viper.BindPFlag("handshake-burst", rootCmd.Flags().Lookup("handshake-burst"))
+	_ = viper.BindPFlag("ban-threshold", rootCmd.Flags().Lookup("ban-threshold"))
+	_ = viper.BindPFlag("ban-duration", rootCmd.Flags().Lookup("ban-duration"))
+	_ = viper.BindPFlag("registered-devices-only", rootCmd.Flags().Lookup("registered-devices-only"))
+	_ = viper.BindPFlag("debug-devices", rootCmd.Flags().Lookup("debug-devices"))
+	_ = viper.BindPFlag("metrics-address", rootCmd.Flags().Lookup("metrics-address"))
+	_ = viper.BindPFlag("workers", rootCmd.Flags().Lookup("workers"))
+	_ = viper.BindPFlag("queue-size", rootCmd.Flags().Lookup("queue-size"))
+	_ = viper.BindPFlag("backpressure", rootCmd.Flags().Lookup("backpressure"))
+	_ = viper.BindPFlag("spill-dir", rootCmd.Flags().Lookup("spill-dir"))
+	_ = viper.BindPFlag("spill-limit", rootCmd.Flags().Lookup("spill-limit"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"ntcb-server/ntcb"
+	"ntcb-server/simulator"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// simulateCmd represents the simulate command
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Simulate devices connected to a NTCB server",
+	Long: `Simulate opens the given number of device connections to a NTCB server,
+performs handshake and flex negotiation and streams telemetry of moving vehicles
+until the duration is elapsed or it's interrupted, then prints ack latencies and errors`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := simulator.Options{
+			Address:          viper.GetString("simulate.address"),
+			Connections:      viper.GetInt("simulate.connections"),
+			IMEIBase:         viper.GetUint64("simulate.imei-base"),
+			FlexVersion:      uint8(viper.GetUint("simulate.flex-version")),
+			Interval:         viper.GetDuration("simulate.interval"),
+			PingInterval:     viper.GetDuration("simulate.ping-interval"),
+			AlarmProbability: viper.GetFloat64("simulate.alarm-probability"),
+			ArrayEvery:       viper.GetInt("simulate.array-every"),
+			ArraySize:        viper.GetInt("simulate.array-size"),
+			IgnitionCycle:    viper.GetDuration("simulate.ignition-cycle"),
+			AckTimeout:       viper.GetDuration("simulate.ack-timeout"),
+			Duration:         viper.GetDuration("simulate.duration"),
+		}
+
+		if s := viper.GetString("simulate.bit-field"); s != "" {
+			ba, err := ntcb.NewBitArrayFromString(s)
+			if err != nil {
+				return fmt.Errorf("invalid bit field: %w", err)
+			}
+			opts.BitField = ba
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		simulator.Run(ctx, opts).Print(os.Stdout)
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(simulateCmd)
+
+	simulateCmd.Flags().String("address", "127.0.0.1:11000", "a server address")
+	simulateCmd.Flags().Int("connections", 1, "a number of simulated devices")
+	simulateCmd.Flags().Uint64("imei-base", 860000000000000, "an IMEI of the first device, the following devices get the next numbers")
+	simulateCmd.Flags().Uint("flex-version", 10, "a proposed flex version: 10 or 20")
+	simulateCmd.Flags().String("bit-field", "", "a proposed flex bit field e.g. 1111000111, all fields of the flex version if empty")
+	simulateCmd.Flags().Duration("interval", 10*time.Second, "an interval between telemetry messages of a device")
+	simulateCmd.Flags().Duration("ping-interval", 0, "an interval between pings of a device, 0 disables pings")
+	simulateCmd.Flags().Float64("alarm-probability", 0.01, "a probability of a telemetry message to be sent as an alarm")
+	simulateCmd.Flags().Int("array-every", 10, "every n-th telemetry message is sent as a backfill array, 0 disables arrays")
+	simulateCmd.Flags().Int("array-size", 10, "a number of records in a backfill array")
+	simulateCmd.Flags().Duration("ignition-cycle", 10*time.Minute, "a duration of a trip and of parking between trips")
+	simulateCmd.Flags().Duration("ack-timeout", 10*time.Second, "a timeout of server replies")
+	simulateCmd.Flags().Duration("duration", 0, "a duration of the simulation, 0 runs until interrupted")
+
+	_ = viper.BindPFlag("simulate.address", simulateCmd.Flags().Lookup("address"))
+	_ = viper.BindPFlag("simulate.connections", simulateCmd.Flags().Lookup("connections"))
+	_ = viper.BindPFlag("simulate.imei-base", simulateCmd.Flags().Lookup("imei-base"))
+	_ = viper.BindPFlag("simulate.flex-version", simulateCmd.Flags().Lookup("flex-version"))
+	_ = viper.BindPFlag("simulate.bit-field", simulateCmd.Flags().Lookup("bit-field"))
+	_ = viper.BindPFlag("simulate.interval", simulateCmd.Flags().Lookup("interval"))
+	_ = viper.BindPFlag("simulate.ping-interval", simulateCmd.Flags().Lookup("ping-interval"))
+	_ = viper.BindPFlag("simulate.alarm-probability", simulateCmd.Flags().Lookup("alarm-probability"))
+	_ = viper.BindPFlag("simulate.array-every", simulateCmd.Flags().Lookup("array-every"))
+	_ = viper.BindPFlag("simulate.array-size", simulateCmd.Flags().Lookup("array-size"))
+	_ = viper.BindPFlag("simulate.ignition-cycle", simulateCmd.Flags().Lookup("ignition-cycle"))
+	_ = viper.BindPFlag("simulate.ack-timeout", simulateCmd.Flags().Lookup("ack-timeout"))
+	_ = viper.BindPFlag("simulate.duration", simulateCmd.Flags().Lookup("duration"))
+}
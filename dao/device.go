@@ -3,10 +3,16 @@ package dao
 import "time"
 
 type Device struct {
-	ID          string
-	Name        string
-	Description string
-	CreatedAt   time.Time
+	ID               string
+	Name             string
+	Description      string
+	Model            string
+	FirmwareVersion  string
+	FirmwareDate     string
+	FirmwareLanguage string
+	ICCID            string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
 }
 
 func (Device) TableName() string {
@@ -0,0 +1,31 @@
+package dao
+
+import (
+	"time"
+)
+
+type ExtendedTelemetryMessage struct {
+	DeviceID          string
+	SeqNo             uint32
+	Timestamp         time.Time
+	EventCode         uint16
+	Alarming          bool
+	NavValid          bool
+	NavSatelliteCount byte
+	NavTimestamp      time.Time
+	Lon               float64
+	Lat               float64
+	Alt               float64
+	Speed             float32
+	Direction         float32
+	Odometer          float32
+	TouchMemoryKey    uint64
+	RFIDCode          uint64
+	DriverCard        string
+	Details           string
+	Tags              string
+}
+
+func (ExtendedTelemetryMessage) TableName() string {
+	return "extended_telemetry"
+}
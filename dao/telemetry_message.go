@@ -28,6 +28,7 @@ type TelemetryMessage struct {
 	BrakePosition     uint8
 	DistUntilService  float32
 	Details           string
+	Tags              string
 }
 
 func (TelemetryMessage) TableName() string {
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS tracking.extended_telemetry;
\ No newline at end of file
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS tracking.extended_telemetry (
+    device_id           FixedString(15),
+    seq_no              UInt32,
+    timestamp           DateTime,
+    event_code          UInt16,
+    alarming            UInt8, -- boolean 0 or 1
+    nav_valid           UInt8, -- boolean 0 or 1
+    nav_satellite_count UInt8,
+    nav_timestamp       DateTime,
+    lon                 Float64,
+    lat                 Float64,
+    alt                 Float64,
+    speed               Float32,
+    direction           Float32,
+    odometer            Float32,
+    touch_memory_key    UInt64,
+    rfid_code           UInt64,
+    driver_card         String,
+    details             String
+)
+    ENGINE ReplacingMergeTree() PARTITION BY toYYYYMM(timestamp) ORDER BY (device_id, seq_no) SETTINGS index_granularity = 8192
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS tracking.device;
\ No newline at end of file
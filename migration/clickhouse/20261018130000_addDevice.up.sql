@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS tracking.device (
+    id                FixedString(15),
+    name              String,
+    description       String,
+    model             String,
+    firmware_version  String,
+    firmware_date     String,
+    firmware_language String,
+    iccid             String,
+    created_at        DateTime,
+    updated_at        DateTime
+)
+    ENGINE ReplacingMergeTree(updated_at) ORDER BY id SETTINGS index_granularity = 8192
\ No newline at end of file
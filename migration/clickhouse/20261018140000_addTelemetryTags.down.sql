@@ -0,0 +1,2 @@
+ALTER TABLE tracking.telemetry
+    DROP COLUMN tags;
\ No newline at end of file
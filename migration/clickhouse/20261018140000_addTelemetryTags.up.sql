@@ -0,0 +1,2 @@
+ALTER TABLE tracking.telemetry
+    ADD COLUMN tags String AFTER details;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE tracking.extended_telemetry
+    DROP COLUMN tags;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE tracking.extended_telemetry
+    ADD COLUMN tags String AFTER details;
\ No newline at end of file
@@ -0,0 +1,101 @@
+package ntcb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPersistNotSupported is returned by the persist handlers which don't persist the telemetry, it's passed to
+// TelemetryMessage and ExtendedTelemetryMessage then and acknowledged on receive
+var ErrPersistNotSupported = errors.New("telemetry persistence is not supported")
+
+// AckPolicy defines when the FLEX telemetry is acknowledged, the device deletes the acknowledged records
+// from its black box
+type AckPolicy int
+
+const (
+	// AckOnReceive acknowledges the telemetry once it's decoded, the handlers are called asynchronously by the
+	// workers of the server
+	AckOnReceive AckPolicy = iota
+	// AckOnPersist acknowledges the telemetry once the persist handler succeeds, otherwise the telemetry is left
+	// unacknowledged and the device sends it again. The handler without persistence returns ErrPersistNotSupported,
+	// so the telemetry is acknowledged on receive instead of being dropped.
+	AckOnPersist
+)
+
+func (p AckPolicy) String() string {
+	switch p {
+	case AckOnReceive:
+		return "receive"
+	case AckOnPersist:
+		return "persist"
+	}
+
+	return fmt.Sprintf("AckPolicy(%d)", int(p))
+}
+
+// ParseAckPolicy parses the policy name: receive or persist
+func ParseAckPolicy(s string) (AckPolicy, error) {
+	switch s {
+	case "", "receive":
+		return AckOnReceive, nil
+	case "persist":
+		return AckOnPersist, nil
+	}
+
+	return AckOnReceive, fmt.Errorf("unknown ack policy %q", s)
+}
+
+// deliverTelemetryMessages passes the telemetry to the handlers, an error is returned if the telemetry
+// must not be acknowledged
+func (c *Conn) deliverTelemetryMessages(tms []TelemetryMessage) error {
+	if c.ackPolicy == AckOnPersist {
+		c.suspendLiveness()
+		err := c.persistTelemetryMessages(c, tms)
+		c.resumeLiveness()
+		if err == nil {
+			return nil
+		}
+		if err != ErrPersistNotSupported {
+			return DataExchangeError("telemetry is not persisted: " + err.Error())
+		}
+	}
+
+	if c.pool != nil {
+		for i := range tms {
+			c.pool.pushTelemetryMessage(c, &tms[i])
+		}
+	}
+
+	return nil
+}
+
+func (c *Conn) deliverExtendedTelemetryMessages(tms []ExtendedTelemetryMessage) error {
+	if c.ackPolicy == AckOnPersist {
+		c.suspendLiveness()
+		err := c.persistExtendedTelemetryMessages(c, tms)
+		c.resumeLiveness()
+		if err == nil {
+			return nil
+		}
+		if err != ErrPersistNotSupported {
+			return DataExchangeError("extended telemetry is not persisted: " + err.Error())
+		}
+	}
+
+	if c.pool != nil {
+		for i := range tms {
+			c.pool.pushExtendedTelemetryMessage(c, &tms[i])
+		}
+	}
+
+	return nil
+}
+
+// deliverCurrentState passes the current state reply to the handlers, it's not acknowledged, so the persist
+// error is only logged
+func (c *Conn) deliverCurrentState(tm TelemetryMessage) {
+	if err := c.deliverTelemetryMessages([]TelemetryMessage{tm}); err != nil {
+		c.log(LevelError, "current state is not delivered", Field{"err", err})
+	}
+}
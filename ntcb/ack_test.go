@@ -0,0 +1,80 @@
+package ntcb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestAckOnPersist(t *testing.T) {
+	var rw = &bytes.Buffer{}
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+
+	var persisted []uint32
+	persistErr := errors.New("storage is unavailable")
+	c := Conn{conn: faker{ReadWriter: rw}, flexBitField: ba, ackPolicy: AckOnPersist,
+		persistTelemetryMessages: func(c *Conn, tms []TelemetryMessage) error {
+			if persistErr != nil {
+				return persistErr
+			}
+			for _, tm := range tms {
+				persisted = append(persisted, tm.SeqNo)
+			}
+			return nil
+		},
+	}
+
+	flex10TelemetryMessageBytes, _ := hex.DecodeString(flex10TelemetryMessage)
+
+	err := handleDeviceBytes(&c, rw, flex10TelemetryMessageBytes)
+	if !IsNTCBDataExchangeError(err) || rw.Len() != 0 {
+		t.Fatalf("unexpected ack of unpersisted telemetry %x, %v", rw.Bytes(), err)
+	}
+
+	persistErr = nil
+	if err := handleDeviceBytes(&c, rw, flex10TelemetryMessageBytes); err != nil {
+		t.Fatalf("unexpected error processing flex 1.0 telemetry message, %v", err)
+	}
+	if hex.EncodeToString(rw.Bytes()) != "7e540d00000090" || len(persisted) != 1 || persisted[0] != 0xd {
+		t.Errorf("unexpected ack %x of persisted telemetry %v", rw.Bytes(), persisted)
+	}
+}
+
+func TestAckOnPersistWithoutPersistence(t *testing.T) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	flex10TelemetryMessageBytes, _ := hex.DecodeString(flex10TelemetryMessage)
+
+	for name, h := range map[string]Handler{
+		"nop handler":          NopHandler{},
+		"no persist callbacks": callbacksHandler{opts: &ServerOptions{AckPolicy: AckOnPersist}},
+	} {
+		var rw = &bytes.Buffer{}
+		handled := make(chan TelemetryMessage, 1)
+		c := Conn{conn: faker{ReadWriter: rw}, flexBitField: ba, ackPolicy: AckOnPersist,
+			persistTelemetryMessages: h.PersistTelemetryMessages, pool: telemetryPool(t, handled)}
+		if err := handleDeviceBytes(&c, rw, flex10TelemetryMessageBytes); err != nil {
+			t.Fatalf("%s: unexpected error processing flex 1.0 telemetry message, %v", name, err)
+		}
+
+		// the telemetry is acknowledged on receive instead of being dropped
+		if hex.EncodeToString(rw.Bytes()) != "7e540d00000090" {
+			t.Errorf("%s: unexpected ack %x", name, rw.Bytes())
+		}
+		if tm := <-handled; tm.SeqNo != 0xd {
+			t.Errorf("%s: unexpected telemetry message, %#v", name, tm)
+		}
+	}
+}
+
+func TestParseAckPolicy(t *testing.T) {
+	for _, p := range []AckPolicy{AckOnReceive, AckOnPersist} {
+		if parsed, err := ParseAckPolicy(p.String()); err != nil || parsed != p {
+			t.Errorf("unexpected ack policy %v parsed from %s, %v", parsed, p, err)
+		}
+	}
+
+	if _, err := ParseAckPolicy("never"); err == nil {
+		t.Errorf("expected unknown ack policy error")
+	}
+}
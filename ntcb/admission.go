@@ -0,0 +1,187 @@
+package ntcb
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AdmissionError closes the connection rejected by the admission limits, the rejections aren't offenses
+type AdmissionError string
+
+func (e AdmissionError) Error() string {
+	return string(e)
+}
+
+var (
+	ErrTooManyConnections       = AdmissionError("too many connections")
+	ErrTooManyConnectionsFromIP = AdmissionError("too many connections from the IP")
+	ErrHandshakeRateExceeded    = AdmissionError("handshake rate of the IP is exceeded")
+	ErrBanned                   = AdmissionError("IP is temporarily banned")
+)
+
+// ipAdmission is the admission state of an IP
+type ipAdmission struct {
+	conns int
+	// handshake token bucket
+	tokens      float64
+	tokensAt    time.Time
+	offenses    int
+	offenseAt   time.Time
+	bannedUntil time.Time
+}
+
+// admission applies the per-IP limits and bans of the server options
+type admission struct {
+	opts *ServerOptions
+
+	mu      sync.Mutex
+	ips     map[string]*ipAdmission
+	sweptAt time.Time
+}
+
+func newAdmission(opts *ServerOptions) *admission {
+	return &admission{opts: opts, ips: make(map[string]*ipAdmission), sweptAt: time.Now()}
+}
+
+// enabled reports whether the per-IP state is tracked
+func (a *admission) enabled() bool {
+	return a.opts.MaxConnsPerIP > 0 || a.opts.HandshakeRate > 0 || a.opts.BanThreshold > 0
+}
+
+// accept admits the connection from the IP, released must be called once the admitted connection is closed
+func (a *admission) accept(ip string) error {
+	if !a.enabled() {
+		return nil
+	}
+
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(now)
+
+	s := a.ip(ip, now)
+	if now.Before(s.bannedUntil) {
+		return ErrBanned
+	}
+	if a.opts.MaxConnsPerIP > 0 && s.conns >= a.opts.MaxConnsPerIP {
+		return ErrTooManyConnectionsFromIP
+	}
+	s.conns++
+
+	return nil
+}
+
+// release forgets the admitted connection, the connection which broke the protocol is the offense
+// of the IP, which is banned for BanDuration after BanThreshold offenses. True is returned if the IP is banned.
+func (a *admission) release(ip string, offense bool) bool {
+	if !a.enabled() {
+		return false
+	}
+
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.ip(ip, now)
+	if s.conns > 0 {
+		s.conns--
+	}
+
+	if !offense || a.opts.BanThreshold <= 0 {
+		return false
+	}
+
+	// offenses are forgotten after BanDuration without them
+	if now.Sub(s.offenseAt) > a.opts.BanDuration {
+		s.offenses = 0
+	}
+	s.offenses++
+	s.offenseAt = now
+	if s.offenses < a.opts.BanThreshold {
+		return false
+	}
+	s.offenses = 0
+	s.bannedUntil = now.Add(a.opts.BanDuration)
+
+	return true
+}
+
+// handshake takes the handshake token of the IP
+func (a *admission) handshake(ip string) error {
+	if a.opts.HandshakeRate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.ip(ip, now)
+	s.tokens += now.Sub(s.tokensAt).Seconds() * a.opts.HandshakeRate
+	if burst := a.burst(); s.tokens > burst {
+		s.tokens = burst
+	}
+	s.tokensAt = now
+
+	if s.tokens < 1 {
+		return ErrHandshakeRateExceeded
+	}
+	s.tokens--
+
+	return nil
+}
+
+func (a *admission) burst() float64 {
+	if a.opts.HandshakeBurst > 0 {
+		return float64(a.opts.HandshakeBurst)
+	}
+
+	return 1
+}
+
+// ip returns the state of the IP, the new IP starts with the full token bucket
+func (a *admission) ip(ip string, now time.Time) *ipAdmission {
+	s, ok := a.ips[ip]
+	if !ok {
+		s = &ipAdmission{tokens: a.burst(), tokensAt: now}
+		a.ips[ip] = s
+	}
+
+	return s
+}
+
+// sweep forgets the IPs without connections, bans and offenses once a minute, their token buckets are full by then
+// unless the rate is lower than a token per minute
+func (a *admission) sweep(now time.Time) {
+	if now.Sub(a.sweptAt) < time.Minute {
+		return
+	}
+	a.sweptAt = now
+
+	for ip, s := range a.ips {
+		refilled := a.opts.HandshakeRate <= 0 || now.Sub(s.tokensAt).Seconds()*a.opts.HandshakeRate >= a.burst()
+		if s.conns == 0 && now.After(s.bannedUntil) && now.Sub(s.offenseAt) > a.opts.BanDuration && refilled {
+			delete(a.ips, ip)
+		}
+	}
+}
+
+// isOffense reports whether the connection closed with the error broke the protocol: it failed the handshake
+// e.g. a scanner, or sent the malformed frame
+func isOffense(err error, handshaked bool) bool {
+	switch err := err.(type) {
+	case FrameError:
+		return err.Fatal || !handshaked
+	case ProtocolError:
+		return !handshaked && err != ErrServerClosed && err != ErrDuplicateDevice
+	case net.Error:
+		return !handshaked && err.Timeout()
+	}
+
+	return false
+}
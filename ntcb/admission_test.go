@@ -0,0 +1,143 @@
+package ntcb
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshakeFrom connects the device from the address and sends the handshake, or the data if it's set
+func handshakeFrom(s *Server, addr string, data []byte) (net.Conn, error) {
+	serverConn, deviceConn := net.Pipe()
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	s.handleNewConnection(remoteAddrConn{Conn: serverConn, addr: tcpAddr})
+
+	if data == nil {
+		data = NewEncoder(nil).Handshake("100000000000000")
+	}
+	if _, err := deviceConn.Write(data); err != nil {
+		return deviceConn, err
+	}
+
+	reply := make([]byte, ntcbHeaderSize+3)
+	_, err := io.ReadFull(deviceConn, reply)
+	return deviceConn, err
+}
+
+func TestServerAdmission(t *testing.T) {
+	garbage := []byte("GET / HTTP/1.1\r\n\r\n")
+
+	tests := []struct {
+		name string
+		opts ServerOptions
+		// connections made in turn, the rejected one is closed with err
+		addrs []string
+		data  [][]byte
+		err   error
+	}{
+		{
+			name:  "max connections",
+			opts:  ServerOptions{MaxConns: 1, DuplicatePolicy: DuplicateAllow},
+			addrs: []string{"10.0.0.1:1000", "10.0.0.2:1000"},
+			err:   ErrTooManyConnections,
+		},
+		{
+			name:  "max connections per IP",
+			opts:  ServerOptions{MaxConnsPerIP: 1, DuplicatePolicy: DuplicateAllow},
+			addrs: []string{"10.0.0.1:1000", "10.0.0.2:1000", "10.0.0.1:1001"},
+			err:   ErrTooManyConnectionsFromIP,
+		},
+		{
+			name:  "handshake rate",
+			opts:  ServerOptions{HandshakeRate: 0.01, HandshakeBurst: 2, DuplicatePolicy: DuplicateAllow},
+			addrs: []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.2:1000", "10.0.0.1:1002"},
+			err:   ErrHandshakeRateExceeded,
+		},
+		{
+			name:  "ban",
+			opts:  ServerOptions{BanThreshold: 2, BanDuration: time.Minute},
+			addrs: []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.1:1002"},
+			data:  [][]byte{garbage, garbage, nil},
+			err:   ErrBanned,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closed := make(chan error, len(tt.addrs))
+			banned := make(chan string, 1)
+			tt.opts.OnConnectionClosed = func(c *Conn, err error) {
+				closed <- err
+			}
+			tt.opts.OnIPBanned = func(ip string, d time.Duration) {
+				banned <- ip
+			}
+			s := NewServer(tt.opts)
+			defer s.Stop()
+
+			last := len(tt.addrs) - 1
+			for i, addr := range tt.addrs {
+				var data []byte
+				if tt.data != nil {
+					data = tt.data[i]
+				}
+
+				conn, err := handshakeFrom(s, addr, data)
+				defer conn.Close()
+
+				if i < last && data == nil && err != nil {
+					t.Fatalf("connection %d from %s is rejected, %v", i, addr, err)
+				}
+				if i < last && data != nil {
+					// closed by the server as the data is not a valid frame
+					if err := <-closed; err == nil {
+						t.Fatalf("connection %d from %s is not closed with an error", i, addr)
+					}
+				}
+				if i == last && err == nil {
+					t.Fatalf("connection %d from %s is not rejected", i, addr)
+				}
+			}
+
+			select {
+			case err := <-closed:
+				if err != tt.err {
+					t.Errorf("got error %v, want %v", err, tt.err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("connection is not closed")
+			}
+
+			if tt.opts.BanThreshold > 0 {
+				if ip := <-banned; ip != "10.0.0.1" {
+					t.Errorf("unexpected banned IP %s", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestIsOffense(t *testing.T) {
+	tests := []struct {
+		err        error
+		handshaked bool
+		offense    bool
+	}{
+		{err: ProtocolError("handshake: unexpected end of file"), offense: true},
+		{err: ErrUnknownFrame, offense: true},
+		{err: ErrUnknownFrame, handshaked: true, offense: true},
+		{err: ErrCheckSumMismatch, handshaked: true},
+		{err: ErrBanned},
+		{err: ErrDuplicateDevice},
+		{err: ErrServerClosed},
+		{err: ErrReadTimeout, handshaked: true},
+		{err: io.EOF},
+	}
+
+	for _, tt := range tests {
+		if offense := isOffense(tt.err, tt.handshaked); offense != tt.offense {
+			t.Errorf("got offense %t for %v, handshaked %t", offense, tt.err, tt.handshaked)
+		}
+	}
+}
@@ -14,6 +14,16 @@ func (ba BitArray) IsSet(i int) bool {
 	return ba[i/8]&(1<<(7-i%8)) > 0
 }
 
+// truncate returns a copy of the bit array with the bits from n up cleared
+func (ba BitArray) truncate(n int) BitArray {
+	t := append(BitArray(nil), ba...)
+	for i := n; i < len(t)*8; i++ {
+		t[i/8] &^= 1 << (7 - i%8)
+	}
+
+	return t
+}
+
 func NewBitArrayFromString(s string) (BitArray, error) {
 	if len(s)%8 != 0 {
 		s += strings.Repeat("0", 8-len(s)%8)
@@ -0,0 +1,267 @@
+package ntcb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidCommand       = DataExchangeError("invalid command")
+	ErrCommandTimeout       = DataExchangeError("command timeout")
+	ErrConnectionClosed     = DataExchangeError("connection closed")
+	ErrHandshakeNotComplete = DataExchangeError("handshake is not completed")
+	ErrDeviceNotConnected   = DataExchangeError("device is not connected")
+	ErrFlexNotNegotiated    = DataExchangeError("flex protocol is not negotiated")
+)
+
+// defaultCommandTimeout is applied when the context passed to SendCommand has no deadline
+const defaultCommandTimeout = 30 * time.Second
+
+// Command is a body of NTCB command (*!) or request (*?) sent to the device
+type Command []byte
+
+var (
+	CommandDeviceReset = Command("*!DEV_RESET")
+	CommandChangeSIM   = Command("*!CHNGSIM")
+	CommandGuardOn     = Command("*!GY")
+	CommandGuardOff    = Command("*!GN")
+)
+
+// currentStateRequest is the FLEX request of the current state, device replies with ~C message
+var currentStateRequest = []byte("~C")
+
+// CommandOutput switches output line (1-4) on or off
+func CommandOutput(line int, on bool) Command {
+	state := 'N'
+	if on {
+		state = 'Y'
+	}
+
+	return Command(fmt.Sprintf("*!%d%c", line, state))
+}
+
+// CommandInput blocks or unblocks input line (1-9)
+func CommandInput(line int, enabled bool) Command {
+	if enabled {
+		return Command(fmt.Sprintf("*!ON:%d", line))
+	}
+
+	return Command(fmt.Sprintf("*!OFF:%d", line))
+}
+
+// replyPrefix returns the prefix of the device reply echoing the command name without the arguments,
+// commands *!<name> are answered with *@<name>, requests *?<name> with *#<name>
+func (cmd Command) replyPrefix() ([]byte, error) {
+	if len(cmd) < 3 || cmd[0] != '*' {
+		return nil, ErrInvalidCommand
+	}
+
+	name := cmd[2:]
+	if i := bytes.IndexByte(name, ':'); i >= 0 {
+		name = name[:i]
+	}
+	if len(name) == 0 {
+		return nil, ErrInvalidCommand
+	}
+
+	switch cmd[1] {
+	case '!':
+		return append([]byte("*@"), name...), nil
+	case '?':
+		return append([]byte("*#"), name...), nil
+	}
+
+	return nil, ErrInvalidCommand
+}
+
+type pendingCommand struct {
+	replyPrefix []byte
+	reply       chan commandReply
+}
+
+type commandReply struct {
+	body []byte
+	// telemetry record carried by the reply, if any
+	telemetryMessage *TelemetryMessage
+	// err is set if the reply is received but can't be decoded
+	err error
+}
+
+// SendCommand sends the command to the device and waits for its reply, the NTCB protocol is not full duplex,
+// so commands to the same device are sent one at a time. Returned reply is the NTCB message body without header.
+func (c *Conn) SendCommand(ctx context.Context, cmd Command) ([]byte, error) {
+	reply, err := c.sendCommand(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.body, nil
+}
+
+// RequestCurrentState requests the current state of the device with FLEX ~C request, received telemetry message
+// is also passed to the telemetry message handler as a message of MessageTypeCurrent
+func (c *Conn) RequestCurrentState(ctx context.Context) (TelemetryMessage, error) {
+	c.stateMu.Lock()
+	negotiated := c.flexBitField != nil
+	c.stateMu.Unlock()
+	if !negotiated {
+		return TelemetryMessage{}, ErrFlexNotNegotiated
+	}
+
+	reply, err := c.roundTrip(ctx, currentStateRequest, func() error {
+		return c.writeFlexReply(currentStateRequest, nil)
+	})
+	if err != nil {
+		return TelemetryMessage{}, err
+	}
+	if reply.err != nil {
+		return TelemetryMessage{}, reply.err
+	}
+
+	return *reply.telemetryMessage, nil
+}
+
+// PollCurrentState periodically requests the current state of the device, zero interval stops polling
+func (c *Conn) PollCurrentState(interval time.Duration) {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+
+	if c.pollStop != nil {
+		close(c.pollStop)
+		c.pollStop = nil
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.pollStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-c.done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				_, err := c.RequestCurrentState(ctx)
+				cancel()
+
+				if err != nil && err != ErrFlexNotNegotiated {
+					c.log(LevelWarn, "current state polling error", Field{"err", err})
+				}
+			}
+		}
+	}()
+}
+
+func (c *Conn) sendCommand(ctx context.Context, cmd Command) (commandReply, error) {
+	replyPrefix, err := cmd.replyPrefix()
+	if err != nil {
+		return commandReply{}, err
+	}
+
+	// commands are addressed the same way as the reply to the device handshake
+	return c.roundTrip(ctx, replyPrefix, func() error {
+		return c.writeNTCBReply(c.header, []byte(cmd))
+	})
+}
+
+// roundTrip writes the request and waits for the reply starting with the prefix, requests to the same device
+// are sent one at a time
+func (c *Conn) roundTrip(ctx context.Context, replyPrefix []byte, write func() error) (commandReply, error) {
+	if c.id == "" {
+		return commandReply{}, ErrHandshakeNotComplete
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultCommandTimeout)
+		defer cancel()
+	}
+
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	pc := &pendingCommand{replyPrefix: replyPrefix, reply: make(chan commandReply, 1)}
+
+	c.pendingMu.Lock()
+	c.pending = pc
+	c.pendingMu.Unlock()
+
+	defer func() {
+		c.pendingMu.Lock()
+		c.pending = nil
+		c.pendingMu.Unlock()
+	}()
+
+	if err := write(); err != nil {
+		return commandReply{}, err
+	}
+
+	select {
+	case reply := <-pc.reply:
+		return reply, nil
+	case <-c.done:
+		return commandReply{}, ErrConnectionClosed
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return commandReply{}, ErrCommandTimeout
+		}
+		return commandReply{}, ctx.Err()
+	}
+}
+
+func (c *Conn) handleCommandResponse(body []byte) error {
+	// body refers to the decoder buffer, which is reused by the next frame
+	if !c.resolvePending(body, commandReply{body: append([]byte(nil), body...)}) && c.Debug() {
+		// late reply to the timed out command or the reply to no command at all
+		c.log(LevelDebug, "unexpected command response", Field{"msg", body})
+	}
+
+	return nil
+}
+
+// handleCurrentState passes the ~C reply to the handlers and to the pending current state request. The reply
+// isn't acknowledged, as ~C sent back to the device is the next request.
+func (c *Conn) handleCurrentState(f *Frame) error {
+	tm := f.TelemetryMessages[0]
+	c.deliverCurrentState(tm)
+	c.resolvePending(f.Raw[:2], commandReply{telemetryMessage: &tm})
+
+	return nil
+}
+
+// currentStateFailed fails the pending current state request once its reply can't be decoded, so the request
+// doesn't wait for the timeout
+func (c *Conn) currentStateFailed(err error) {
+	c.resolvePending(currentStateRequest, commandReply{err: err})
+}
+
+// resolvePending passes the reply to the pending request if the reply starts with the prefix it waits for,
+// false is returned if there is no such request
+func (c *Conn) resolvePending(reply []byte, r commandReply) bool {
+	c.pendingMu.Lock()
+	pc := c.pending
+	if pc != nil && bytes.HasPrefix(reply, pc.replyPrefix) {
+		c.pending = nil
+	} else {
+		pc = nil
+	}
+	c.pendingMu.Unlock()
+
+	if pc == nil {
+		return false
+	}
+	pc.reply <- r
+
+	return true
+}
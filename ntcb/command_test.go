@@ -0,0 +1,211 @@
+package ntcb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func writeDeviceReply(w io.Writer, h Header, body []byte) {
+	_, _ = w.Write(appendNTCBMessage(nil, Header{Pre: h.Pre, IDr: h.IDs, IDs: h.IDr}, body))
+}
+
+func TestConnSendCommand(t *testing.T) {
+	serverConn, deviceConn := net.Pipe()
+	defer deviceConn.Close()
+
+	// device 0 connected to the server 1
+	c := &Conn{conn: serverConn, id: "100000000000000", header: Header{Pre: [4]byte{'@', 'N', 'T', 'C'}, IDr: 1}, done: make(chan struct{})}
+	defer c.Close()
+
+	go func() {
+		_ = c.readLoop()
+	}()
+
+	go func() {
+		f, err := NewDecoder(deviceConn).Decode()
+		if err != nil {
+			t.Errorf("unexpected error reading command, %v", err)
+			return
+		}
+
+		if f.Header.IDr != 0 || f.Header.IDs != 1 {
+			t.Errorf("unexpected command addressing, %+v", f.Header)
+		}
+
+		if string(f.Body) != "*!1Y" {
+			t.Errorf("unexpected command, %q", f.Body)
+		}
+
+		writeDeviceReply(deviceConn, f.Header, []byte("*@1Y"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := c.SendCommand(ctx, CommandOutput(1, true))
+	if err != nil {
+		t.Fatalf("unexpected error sending command, %v", err)
+	}
+
+	if string(reply) != "*@1Y" {
+		t.Errorf("unexpected command reply, %q", reply)
+	}
+
+	if _, err := c.SendCommand(ctx, Command("1Y")); err != ErrInvalidCommand {
+		t.Errorf("expected invalid command error, got %v", err)
+	}
+}
+
+func TestConnSendCommandStaleReply(t *testing.T) {
+	serverConn, deviceConn := net.Pipe()
+	defer deviceConn.Close()
+
+	c := &Conn{conn: serverConn, id: "100000000000000", header: Header{Pre: [4]byte{'@', 'N', 'T', 'C'}, IDr: 1}, done: make(chan struct{})}
+	defer c.Close()
+
+	go func() {
+		_ = c.readLoop()
+	}()
+
+	timedOut := make(chan struct{})
+	go func() {
+		d := NewDecoder(deviceConn)
+		f, err := d.Decode()
+		if err != nil || string(f.Body) != "*?V" {
+			t.Errorf("unexpected version request %q, %v", f.Body, err)
+			return
+		}
+
+		<-timedOut
+		f, err = d.Decode()
+		if err != nil || string(f.Body) != "*?ICCID" {
+			t.Errorf("unexpected ICCID request %q, %v", f.Body, err)
+			return
+		}
+
+		// the version reply comes after the request timed out
+		writeDeviceReply(deviceConn, f.Header, []byte("*#V:E-1110:01.00.53:07.02.08:RU"))
+		writeDeviceReply(deviceConn, f.Header, []byte("*#ICCID:8970199170000000000"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.SendCommand(ctx, CommandVersion); err != ErrCommandTimeout {
+		t.Fatalf("expected command timeout, got %v", err)
+	}
+	close(timedOut)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := c.SendCommand(ctx, CommandICCID)
+	if err != nil {
+		t.Fatalf("unexpected error sending command, %v", err)
+	}
+	if string(reply) != "*#ICCID:8970199170000000000" {
+		t.Errorf("unexpected command reply, %q", reply)
+	}
+}
+
+func TestConnRequestCurrentState(t *testing.T) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+
+	// telemetry record of the ~T message without event index and crc
+	flex10TelemetryMessageBytes, _ := hex.DecodeString(flex10TelemetryMessage)
+	record := flex10TelemetryMessageBytes[6 : len(flex10TelemetryMessageBytes)-1]
+	current := appendCRC8(append([]byte("~C"), record...))
+	corrupted := append([]byte(nil), current...)
+	corrupted[len(corrupted)-1]++
+
+	for name, reply := range map[string][]byte{"current state": current, "corrupted reply": corrupted} {
+		t.Run(name, func(t *testing.T) {
+			serverConn, deviceConn := net.Pipe()
+			defer deviceConn.Close()
+
+			handled := make(chan TelemetryMessage, 1)
+			c := &Conn{
+				conn:         serverConn,
+				id:           "100000000000000",
+				header:       Header{Pre: [4]byte{'@', 'N', 'T', 'C'}, IDr: 1},
+				done:         make(chan struct{}),
+				flexBitField: ba,
+				pool:         telemetryPool(t, handled),
+			}
+			defer c.Close()
+
+			go func() {
+				_ = c.readLoop()
+			}()
+
+			go func() {
+				request := make([]byte, 3)
+				if _, err := io.ReadFull(deviceConn, request); err != nil {
+					t.Errorf("unexpected error reading request, %v", err)
+					return
+				}
+
+				if !bytes.Equal(request, appendCRC8([]byte("~C"))) {
+					t.Errorf("unexpected request, %x", request)
+				}
+
+				_, _ = deviceConn.Write(reply)
+			}()
+
+			// the corrupted reply fails the request without waiting for the timeout
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			tm, err := c.RequestCurrentState(ctx)
+			if name == "corrupted reply" {
+				if fe, ok := err.(FrameError); !ok || fe.Kind != FrameErrorChecksum || ctx.Err() != nil {
+					t.Errorf("unexpected error requesting current state, %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error requesting current state, %v", err)
+			}
+
+			if tm.Type != MessageTypeCurrent || tm.SeqNo != 0xd || tm.CANSpeed != 0x36 {
+				t.Errorf("unexpected current state, %#v", tm)
+			}
+
+			if handled := <-handled; handled != tm {
+				t.Errorf("unexpected handled telemetry message, %#v", handled)
+			}
+		})
+	}
+}
+
+func TestConnRequestCurrentStateNotNegotiated(t *testing.T) {
+	var rw = &bytes.Buffer{}
+	c := &Conn{conn: faker{ReadWriter: rw}, id: "100000000000000", done: make(chan struct{})}
+
+	if _, err := c.RequestCurrentState(context.Background()); err != ErrFlexNotNegotiated {
+		t.Errorf("expected flex not negotiated, got %v", err)
+	}
+	if rw.Len() != 0 {
+		t.Errorf("unexpected request sent before negotiation, %x", rw.Bytes())
+	}
+}
+
+func TestParseVersionReply(t *testing.T) {
+	info, err := parseVersionReply([]byte("*#V:E-1110:01.00.53:07.02.08:RU"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing version reply, %v", err)
+	}
+
+	if info != (DeviceInfo{Model: "E-1110", FirmwareVersion: "01.00.53", FirmwareDate: "07.02.08", FirmwareLanguage: "RU"}) {
+		t.Errorf("unexpected device info, %#v", info)
+	}
+
+	if _, err := parseVersionReply([]byte("*#V:E-1110")); err == nil {
+		t.Errorf("expected error parsing truncated version reply")
+	}
+}
@@ -1,21 +1,20 @@
 package ntcb
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"reflect"
-	"strings"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	ErrCheckSumMismatch = DataExchangeError("checksum mismatch")
+	ErrCheckSumMismatch = FrameError{Kind: FrameErrorChecksum, Msg: "checksum mismatch"}
 )
 
 type DataExchangeError string
@@ -24,9 +23,78 @@ func (e DataExchangeError) Error() string {
 	return string(e)
 }
 
+// IsNTCBDataExchangeError reports whether the error leaves the connection usable, so the data exchange
+// may be continued
 func IsNTCBDataExchangeError(err error) bool {
-	_, ok := err.(DataExchangeError)
-	return err != nil && ok
+	switch e := err.(type) {
+	case DataExchangeError:
+		return true
+	case FrameError:
+		return !e.Fatal
+	}
+
+	return false
+}
+
+// FrameErrorKind classifies the errors of the data received from the device
+type FrameErrorKind int
+
+const (
+	// FrameErrorFraming is the data which doesn't form a known frame or has invalid structure
+	FrameErrorFraming FrameErrorKind = iota + 1
+	// FrameErrorChecksum is the frame failed checksum validation
+	FrameErrorChecksum
+	// FrameErrorUnsupportedVersion is the protocol or its version the server doesn't support
+	FrameErrorUnsupportedVersion
+	// FrameErrorTruncated is the frame which is shorter than its content requires
+	FrameErrorTruncated
+)
+
+// frameErrorKinds names the frame error kinds, the names are the Metrics labels, and selects the counters
+// of ConnStats the errors are counted by
+var frameErrorKinds = [...]struct {
+	name    string
+	counter func(s *ConnStats) *int64
+}{
+	FrameErrorFraming:            {"framing", func(s *ConnStats) *int64 { return &s.FramingErrors }},
+	FrameErrorChecksum:           {"checksum", func(s *ConnStats) *int64 { return &s.ChecksumErrors }},
+	FrameErrorUnsupportedVersion: {"unsupported_version", func(s *ConnStats) *int64 { return &s.UnsupportedVersionErrors }},
+	FrameErrorTruncated:          {"truncated", func(s *ConnStats) *int64 { return &s.TruncatedErrors }},
+}
+
+func (k FrameErrorKind) known() bool {
+	return k > 0 && int(k) < len(frameErrorKinds)
+}
+
+func (k FrameErrorKind) String() string {
+	if !k.known() {
+		return "unknown"
+	}
+
+	return frameErrorKinds[k].name
+}
+
+// FrameError is an error of the data received from the device. The invalid frame is not replied, so the device
+// sends it again: the protocol defines no negative replies, the damaged packet and the invalid telemetry are left
+// unacknowledged (docs/protocol_of_information_exchange_navtelecom_v5.5_(160817).pdf, sections 1 and 1.1,
+// pp. 10-12). Fatal errors leave the stream in unknown state and the connection is closed, otherwise the frame
+// is consumed and decoding is continued.
+type FrameError struct {
+	Kind  FrameErrorKind
+	Msg   string
+	Fatal bool
+}
+
+func (e FrameError) Error() string {
+	return e.Msg
+}
+
+func framingError(msg string) FrameError {
+	return FrameError{Kind: FrameErrorFraming, Msg: msg}
+}
+
+func truncatedError(msg string) FrameError {
+	return FrameError{Kind: FrameErrorTruncated, Msg: msg}
 }
 
 type ProtocolError string
@@ -35,12 +103,22 @@ func (e ProtocolError) Error() string {
 	return string(e)
 }
 
-type protoMessageType int
+// PanicError is reported when handling of the connection panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
 
-const (
-	messageTypeHandshake protoMessageType = iota + 1
-	messageTypeProtoNegotiation
-)
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+func newPanicError(c *Conn, v interface{}) *PanicError {
+	err := &PanicError{Value: v, Stack: debug.Stack()}
+	c.log(LevelError, "panic recovered", Field{"err", err}, Field{"stack", string(err.Stack)})
+
+	return err
+}
 
 const (
 	flexProtocolVersion10 = 10
@@ -78,20 +156,76 @@ func xor(d []byte) uint8 {
 }
 
 type Conn struct {
-	debug bool
-
-	conn net.Conn
-
-	proto           uint8
-	protoVersion    uint8
-	structVersion   uint8
-	dataSize        uint8
-	flexBitField    BitArray
-	flexMessageSize uint16
-	id              string
-	lastPingAt      time.Time
-
-	telemetryMessageChan chan TelemetryMessage
+	// unix nanoseconds of the last received data, ping, telemetry and persisted telemetry and the statistics are
+	// accessed atomically, so they're kept first to be 64-bit aligned
+	lastReadAt    int64
+	lastPingAt    int64
+	lastMessageAt int64
+	persistedAt   int64
+	stats         ConnStats
+	// persisting is set to 1 while the read loop persists the telemetry, the liveness checks are suspended
+	persisting int32
+
+	connectedAt time.Time
+
+	// debug is set to 1 to write the debug entries, it's toggled at runtime
+	debug  int32
+	logger Logger
+
+	resync     bool
+	maxGarbage int
+
+	// raw is the accepted connection, conn wraps it with the PROXY header, TLS and session recording
+	raw     net.Conn
+	conn    net.Conn
+	tlsConn *tls.Conn
+	writeMu sync.Mutex
+	// done is closed once by Close
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// handshake header, used to address commands to the device
+	header Header
+
+	cmdMu     sync.Mutex
+	pendingMu sync.Mutex
+	pending   *pendingCommand
+
+	pollMu   sync.Mutex
+	pollStop chan struct{}
+
+	infoMu sync.Mutex
+	info   *DeviceInfo
+
+	// guards the negotiated state read by Info
+	stateMu       sync.Mutex
+	proto         uint8
+	protoVersion  uint8
+	structVersion uint8
+	dataSize      uint8
+	flexBitField  BitArray
+	id            string
+
+	// reason the server closed the connection or stopped reading for, the read loop fails with it
+	closeErr atomic.Value
+	// admit is called on the handshake before the reply, the connection is closed if an error is returned
+	admit func(c *Conn) error
+	// listener the connection is accepted by, nil for the connections created outside of the server
+	listener *listener
+	metrics  Metrics
+	handler  Handler
+
+	// decoder of the device stream, created on the first read
+	decoder *Decoder
+	// reused buffer of the flex replies
+	replyBuf []byte
+
+	// pool queues the telemetry for the handlers
+	pool *workerPool
+
+	ackPolicy                        AckPolicy
+	persistTelemetryMessages         func(c *Conn, tms []TelemetryMessage) error
+	persistExtendedTelemetryMessages func(c *Conn, tms []ExtendedTelemetryMessage) error
 }
 
 func (c *Conn) DeviceID() string {
@@ -102,397 +236,148 @@ func (c *Conn) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
 }
 
-func parseNTCBHeader(r []byte) (h Header, err error) {
-	err = binary.Read(bytes.NewBuffer(r), binary.LittleEndian, &h)
-	return
-}
-
-func parseNTCBMessageType(r []byte) (protoMessageType, error) {
-	switch bs := string(r); {
-	case strings.HasPrefix(bs, "*>S:"):
-		return messageTypeHandshake, nil
-	case strings.HasPrefix(bs, "*>FLEX"):
-		return messageTypeProtoNegotiation, nil
+// dec returns the decoder of the connection, it's seeded with the flex bit field if one is already known
+func (c *Conn) dec() *Decoder {
+	if c.decoder == nil {
+		c.decoder = NewDecoder(c.conn)
+		if c.flexBitField != nil {
+			c.decoder.SetBitField(c.flexBitField)
+		}
+		if c.resync {
+			c.decoder.SetResync(c.maxGarbage)
+		}
 	}
 
-	return 0, nil
+	return c.decoder
 }
 
-func (c *Conn) writeNTCBReply(h Header, body interface{}) error {
-	var bodyBuff bytes.Buffer
-	if err := binary.Write(&bodyBuff, binary.LittleEndian, body); err != nil {
-		return err
-	}
-
-	replHeader := Header{
-		Pre: h.Pre,
-		IDr: h.IDs,
-		IDs: h.IDr,
-		N:   uint16(bodyBuff.Len()),
-		CSd: xor(bodyBuff.Bytes()),
-	}
-
-	replHeader.CSp = replHeader.xor()
+func (c *Conn) handshake() (err error) {
+	defer c.replaceWithCloseReason(&err)
 
-	if err := binary.Write(c.conn, binary.LittleEndian, replHeader); err != nil {
+	// wait 30 sec for the first message
+	if err := c.conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
 		return err
 	}
-	if _, err := c.conn.Write(bodyBuff.Bytes()); err != nil {
+	// the deadline set to stop reading may be overridden
+	if err := c.closeReason(); err != nil {
 		return err
 	}
 
-	if c.debug {
-		log.Printf("ntcb: message sent, remoteAddr=%s, deviceID=%s, msg=%x\n", c.RemoteAddr(), c.id, bodyBuff.Bytes())
-	}
-
-	return nil
-}
-
-func (c *Conn) handleHandshake(h Header, r *bytes.Buffer) (err error) {
-	c.id = r.String()[20:]
-
-	return c.writeNTCBReply(h, []byte("*<S"))
-}
-
-type protoNegotiationMsg struct {
-	Pre             [6]byte
-	Protocol        uint8
-	ProtocolVersion uint8
-	StructVersion   uint8
-}
-
-func (c *Conn) handleProtocolNegotiation(h Header, d []byte) (err error) {
-	// skip *<FLEX
-	bodyBytes := d[6:]
-
-	if bodyBytes[0] != 0xb0 {
-		err = fmt.Errorf("unsupported protocol %s", hex.EncodeToString(bodyBytes[:1]))
-		return
-	}
-
-	c.proto, c.protoVersion, c.structVersion, c.dataSize = bodyBytes[0], bodyBytes[1], bodyBytes[2], bodyBytes[3]
-	c.flexBitField = bodyBytes[4:]
-	c.flexMessageSize = FlexTelemetryMessageSize(c.flexBitField)
-
-	if c.protoVersion != c.structVersion {
-		c.protoVersion, c.structVersion = flexProtocolVersion10, flexProtocolVersion10
-	}
-
-	return c.writeNTCBReply(h, protoNegotiationMsg{
-		Pre:             [6]byte{'*', '<', 'F', 'L', 'E', 'X'},
-		Protocol:        c.proto,
-		ProtocolVersion: flexProtocolVersion10,
-		StructVersion:   flexProtocolVersion10,
-	})
-}
-
-func (c *Conn) readNTCBMessage(buf *bufio.Reader) (header Header, typ protoMessageType, messageBytes *bytes.Buffer, err error) {
-	messageBytes = &bytes.Buffer{}
-	if _, err = io.CopyN(messageBytes, buf, 16); err != nil {
-		return
-	}
-
-	header, err = parseNTCBHeader(messageBytes.Bytes())
-	if err != nil {
-		return
-	}
-
-	if _, err = io.CopyN(messageBytes, buf, int64(header.N)); err != nil {
-		return
-	}
-
-	// validate crc
-	if header.xor() != header.CSp {
-		err = ErrCheckSumMismatch
-		return
-	}
-	if xor(messageBytes.Bytes()[16:]) != header.CSd {
-		err = ErrCheckSumMismatch
-		return
-	}
-
-	typ, err = parseNTCBMessageType(messageBytes.Bytes()[16:])
-
-	return
-}
-
-func (c *Conn) handleNTCBMessage(buffReader *bufio.Reader) error {
-	header, msgType, msgBuff, err := c.readNTCBMessage(buffReader)
+	f, err := c.dec().Decode()
+	c.countRead(c.dec(), f, err)
+	c.frameDecoded(f, err)
 	if err != nil {
-		return err
-	}
-
-	if c.debug {
-		log.Printf("ntcb: message recieved, remoteAddr=%s, deviceID=%s, msg=%x\n", c.RemoteAddr(), c.id, msgBuff.Bytes())
-	}
-
-	switch msgType {
-	case messageTypeProtoNegotiation:
-		// skip NTCB header
-		if err := c.handleProtocolNegotiation(header, msgBuff.Bytes()[16:]); err != nil {
-			return err
-		}
-	default:
-		if c.debug {
-			log.Printf("unrecognized NTCB message, remoteAddr=%s, deviceID=%s, type=%d\n", c.RemoteAddr(), c.id, msgType)
-		}
-
-		return nil
-	}
-
-	return nil
-}
-
-func (c *Conn) writeFlexReply(flexHeader []byte, body interface{}) error {
-	var replBuffer = &bytes.Buffer{}
-	if _, err := replBuffer.Write(flexHeader); err != nil {
-		return err
-	}
-
-	if !reflect.ValueOf(body).IsNil() {
-		if err := binary.Write(replBuffer, binary.LittleEndian, body); err != nil {
-			return err
+		if err == io.EOF {
+			return ProtocolError("handshake: unexpected end of file")
 		}
-	}
-
-	crc := CRC8(replBuffer.Bytes())
-	if err := replBuffer.WriteByte(crc); err != nil {
 		return err
 	}
-
-	_, err := c.conn.Write(replBuffer.Bytes())
-
-	if c.debug {
-		log.Printf("ntcb: message sent, remoteAddr=%s, deviceID=%s, msg=%x\n", c.RemoteAddr(), c.id, replBuffer.Bytes())
-	}
-	return err
-}
-
-func readTelemetryMessage(r io.Reader, ba BitArray) (*RawTelemetryMessage, error) {
-	var te RawTelemetryMessage
-	teValue := reflect.ValueOf(&te).Elem()
-
-	for i := 0; i < 122; i++ {
-		if ba.IsSet(i) {
-			fieldValue := teValue.Field(i)
-			if err := binary.Read(r, binary.LittleEndian, fieldValue.Addr().Interface()); err != nil {
-				return nil, DataExchangeError(err.Error())
-			}
-		}
-	}
-
-	return &te, nil
-}
-
-// handle as single flex message
-func (c *Conn) handleSingleFlexTelemetryMessage(typ MessageType, msgBytes []byte) error {
-	msgCRC8 := CRC8(msgBytes[:len(msgBytes)-1])
-	if msgCRC8 != msgBytes[len(msgBytes)-1] {
-		return ErrCheckSumMismatch
-	}
-
-	flexHeader := msgBytes[:2]
-
-	msgBuff := bytes.NewBuffer(msgBytes[2:])
-	var eventIndex *uint32
-
-	if typ != MessageTypeCurrent {
-		var ei uint32
-		eventIndex = &ei
-		if err := binary.Read(msgBuff, binary.LittleEndian, eventIndex); err != nil {
-			return err
-		}
-	}
-
-	te, err := readTelemetryMessage(msgBuff, c.flexBitField)
-	if err != nil {
-		return err
+	if f.Type != FrameTypeHandshake {
+		return ProtocolError("handshake: invalid message type")
 	}
 
-	if c.telemetryMessageChan != nil {
-		c.telemetryMessageChan <- TelemetryMessage{Type: typ, RawTelemetryMessage: *te}
+	if c.Debug() {
+		c.log(LevelDebug, "handshake", Field{"frameType", f.Type}, Field{"bytes", len(f.Raw)}, Field{"msg", f.Raw})
 	}
 
-	return c.writeFlexReply(flexHeader, eventIndex)
+	return c.handleFrame(f)
 }
 
-func (c *Conn) handleMultipleFlexTelemetryMessage(typ MessageType, msgBytes []byte) error {
-	msgCRC8 := CRC8(msgBytes[:len(msgBytes)-1])
-	if msgCRC8 != msgBytes[len(msgBytes)-1] {
-		return ErrCheckSumMismatch
-	}
-
-	flexHeader := msgBytes[0:2]
+func (c *Conn) readLoop() (err error) {
+	defer c.replaceWithCloseReason(&err)
 
-	msgReader := bytes.NewBuffer(msgBytes[2:])
-	var msgCount byte
-	if err := binary.Read(msgReader, binary.LittleEndian, &msgCount); err != nil {
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
 		return err
 	}
-
-	for i := 0; i < int(msgCount); i++ {
-		te, err := readTelemetryMessage(msgReader, c.flexBitField)
-		if err != nil {
-			return err
-		}
-
-		if c.telemetryMessageChan != nil {
-			c.telemetryMessageChan <- TelemetryMessage{Type: typ, RawTelemetryMessage: *te}
-		}
-	}
-
-	return c.writeFlexReply(flexHeader, &msgCount)
-}
-
-func (c *Conn) handleFlexMessage(buf *bufio.Reader) error {
-	fp, err := buf.Peek(2)
-	if err != nil {
+	if err := c.closeReason(); err != nil {
 		return err
 	}
 
-	switch string(fp) {
-	case "~T":
-		var msgBuff = &bytes.Buffer{}
-		// header (2) + event index (4) + flex message (N) + crc (1)
-		_, err := io.CopyN(msgBuff, buf, 2+4+int64(c.flexMessageSize)+1)
-		if err != nil {
-			return err
-		}
-
-		if c.debug {
-			log.Printf("ntcb: message recieved, remoteAddr=%s, deviceID=%s, msg=%x\n", c.RemoteAddr(), c.id, msgBuff.Bytes())
-		}
-
-		if err := c.handleSingleFlexTelemetryMessage(MessageTypeAlarming, msgBuff.Bytes()); err != nil {
-			return err
-		}
-	case "~C":
-		var msgBuff = &bytes.Buffer{}
-		// header (2) + flex message (N) + crc (1)
-		_, err := io.CopyN(msgBuff, buf, 2+int64(c.flexMessageSize)+1)
-		if err != nil {
-			return err
-		}
-
-		if c.debug {
-			log.Printf("ntcb: message recieved, remoteAddr=%s, deviceID=%s, msg=%x\n", c.RemoteAddr(), c.id, msgBuff.Bytes())
+	d := c.dec()
+	for {
+		skipped := d.Skipped()
+		f, err := d.Decode()
+		readAt := time.Now()
+		atomic.StoreInt64(&c.lastReadAt, readAt.UnixNano())
+		c.countRead(d, f, err)
+		c.frameDecoded(f, err)
+		if skipped != d.Skipped() {
+			c.log(LevelWarn, "stream resynchronized", Field{"skipped", d.Skipped() - skipped})
 		}
 
-		if err := c.handleSingleFlexTelemetryMessage(MessageTypeCurrent, msgBuff.Bytes()); err != nil {
-			return err
-		}
-	case "~A":
-		var msgBuff = &bytes.Buffer{}
-		prefixBytes, err := buf.Peek(3)
-		if err != nil {
-			return err
-		}
-		// header (2) + size (1) + flex message (N) * size + crc (1)
-		_, err = io.CopyN(msgBuff, buf, 2+1+int64(c.flexMessageSize)*int64(prefixBytes[2])+1)
-		if err != nil {
-			return err
+		if err != nil && d.failedType == MessageTypeCurrent {
+			c.currentStateFailed(err)
 		}
 
-		if c.debug {
-			log.Printf("ntcb: message recieved, remoteAddr=%s, deviceID=%s, msg=%x\n", c.RemoteAddr(), c.id, msgBuff.Bytes())
-		}
+		if err == nil {
+			if f.Type != FrameTypePing && c.Debug() {
+				c.log(LevelDebug, "message received", Field{"frameType", f.Type}, Field{"bytes", len(f.Raw)}, Field{"msg", f.Raw})
+			}
 
-		if err := c.handleMultipleFlexTelemetryMessage(MessageTypeArray, msgBuff.Bytes()); err != nil {
-			return err
+			if err = c.handleFrame(f); err != nil {
+				c.countRead(d, nil, err)
+			} else if c.metrics != nil && f.MessageType != MessageTypeCurrent &&
+				(f.Type == FrameTypeTelemetry || f.Type == FrameTypeExtendedTelemetry) {
+				c.metrics.TelemetryAcknowledged(frameTypeLabel(f), time.Since(readAt))
+			}
 		}
 
-	default:
-		if _, err := buf.Discard(buf.Buffered()); err != nil {
+		switch {
+		case err == nil:
+		case err == io.EOF, err == ErrUnknownFrame:
+			return nil
+		case IsNTCBDataExchangeError(err):
+			c.log(LevelWarn, "data exchange error has occurred", Field{"err", err})
+		default:
 			return err
 		}
 	}
-	return nil
 }
 
-func (c *Conn) handshake() error {
-	// wait 30 sec for the first message
-	if err := c.conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
-		return err
-	}
-
-	buffReader := bufio.NewReader(c.conn)
-	header, msgType, msgBuff, err := c.readNTCBMessage(buffReader)
-	if err != nil {
-		if err == io.EOF {
-			return ProtocolError("handshake: unexpected end of file")
-		}
-		return err
-	}
-	if msgType != messageTypeHandshake {
-		return ProtocolError("handshake: invalid message type")
-	}
-
-	if c.debug {
-		log.Printf("ntcb: handshake, remoteAddr=%s, body=%x\n", c.RemoteAddr(), msgBuff.Bytes())
-	}
+// closeReason wraps the error stored in closeErr, as the stored values must be of the same type
+type closeReason struct {
+	err error
+}
 
-	return c.handleHandshake(header, msgBuff)
+// closeWith closes the connection for the reason, the read loop fails with it
+func (c *Conn) closeWith(err error) {
+	c.closeErr.Store(closeReason{err})
+	_ = c.rawConn().Close()
 }
 
-func (c *Conn) readLoop() error {
-	buffReader := bufio.NewReader(c.conn)
+// stopReading makes the read loop fail with the reason once the frame in flight is handled
+func (c *Conn) stopReading(err error) {
+	c.closeErr.Store(closeReason{err})
+	_ = c.rawConn().SetReadDeadline(time.Now())
+}
 
-	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
-		return err
+// rawConn returns the accepted connection, it's safe to use while the connection is being set up
+func (c *Conn) rawConn() net.Conn {
+	if c.raw != nil {
+		return c.raw
 	}
+	return c.conn
+}
 
-	for {
-		b, err := buffReader.Peek(1)
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
-		}
-		switch b[0] {
-		// NTCB message header
-		case '@':
-			if err := c.handleNTCBMessage(buffReader); err != nil {
-				if IsNTCBDataExchangeError(err) {
-					log.Printf("ntcb: data exchange error has occorred,  remoteAddr=%s, deviceID=%s, err=%v\n", c.RemoteAddr(), c.id, err)
-					continue
-				}
-				return err
-			}
-		// FLEX ping
-		case 0x7F:
-			if c.debug {
-				log.Printf("ntcb: ping, remoteAddr=%s, deviceID=%s\n", c.conn.RemoteAddr().String(), c.id)
-			}
-
-			_, err = buffReader.Discard(1)
-			if err != nil {
-				if err == io.EOF {
-					return nil
-				}
-				return err
-			}
-			c.lastPingAt = time.Now()
-			continue
-		// FLEX message
-		case '~':
-			if err := c.handleFlexMessage(buffReader); err != nil {
-				if IsNTCBDataExchangeError(err) {
-					log.Printf("ntcb: data exchange error has occorred,  remoteAddr=%s, deviceID=%s, err=%v\n", c.RemoteAddr(), c.id, err)
-					continue
-				}
-				return err
-			}
-
-		default:
-			return nil
-		}
+// replaceWithCloseReason replaces the error of the closed connection with the reason the server closed it for
+func (c *Conn) replaceWithCloseReason(err *error) {
+	if cerr := c.closeReason(); cerr != nil {
+		*err = cerr
 	}
 }
 
+// closeReason returns the reason the server closed the connection for
+func (c *Conn) closeReason() error {
+	r, _ := c.closeErr.Load().(closeReason)
+	return r.err
+}
+
+// Close closes the connection, it may be called by the handlers as well as by the server
 func (c *Conn) Close() error {
-	if c.telemetryMessageChan != nil {
-		close(c.telemetryMessageChan)
-	}
+	c.closeOnce.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+	})
 	return c.conn.Close()
 }
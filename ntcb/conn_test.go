@@ -6,10 +6,30 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+func TestConnDoubleClose(t *testing.T) {
+	serverConn, deviceConn := net.Pipe()
+	defer deviceConn.Close()
+
+	c := &Conn{conn: serverConn, done: make(chan struct{})}
+	if err := c.Close(); err != nil {
+		t.Fatalf("unexpected error closing connection, %v", err)
+	}
+	// the handler closes the connection, then the server does
+	_ = c.Close()
+
+	select {
+	case <-c.done:
+	default:
+		t.Errorf("done is not closed")
+	}
+}
+
 func TestTelemetryConversion(t *testing.T) {
 	tm := RawTelemetryMessage{CANFuelLevel: 202}
 
@@ -47,7 +67,7 @@ type faker struct {
 
 func (f faker) Close() error                     { return nil }
 func (f faker) LocalAddr() net.Addr              { return nil }
-func (f faker) RemoteAddr() net.Addr             { return nil }
+func (f faker) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
 func (f faker) SetDeadline(time.Time) error      { return nil }
 func (f faker) SetReadDeadline(time.Time) error  { return nil }
 func (f faker) SetWriteDeadline(time.Time) error { return nil }
@@ -72,16 +92,75 @@ func TestConnHandshake(t *testing.T) {
 	}
 }
 
+func TestConnFrameErrorNoReply(t *testing.T) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	e := NewEncoder(ba)
+
+	tests := []struct {
+		kind FrameErrorKind
+		data []byte
+	}{
+		{kind: FrameErrorFraming, data: []byte("GET / HTTP/1.1")},
+		{kind: FrameErrorChecksum, data: append(e.Handshake("100000000000000")[:ntcbHeaderSize+4], "200000000000000"...)},
+		{kind: FrameErrorUnsupportedVersion, data: e.NTCBMessage(append([]byte("*>FLEX\xb1\x0a\x0a\x45"), ba...))},
+		{kind: FrameErrorTruncated, data: appendCRC8([]byte("~X\x01\x00\x00\x00\x01\x00\x0a"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind.String(), func(t *testing.T) {
+			var out bytes.Buffer
+			c := Conn{
+				conn: faker{ReadWriter: struct {
+					io.Reader
+					io.Writer
+				}{bytes.NewReader(tt.data), &out}},
+				flexBitField: ba,
+			}
+
+			_ = c.readLoop()
+
+			if n := atomic.LoadInt64(frameErrorKinds[tt.kind].counter(&c.stats)); n != 1 {
+				t.Fatalf("unexpected number of %s errors, %d", tt.kind, n)
+			}
+			// the spec defines no negative replies, the invalid frame is left unacknowledged
+			if out.Len() != 0 {
+				t.Errorf("unexpected reply to the %s error, %x", tt.kind, out.Bytes())
+			}
+		})
+	}
+}
+
+// handleDeviceBytes feeds the bytes sent by the device through the decoder of the connection reading rw
+func handleDeviceBytes(c *Conn, rw io.Writer, b []byte) error {
+	_, _ = rw.Write(b)
+
+	f, err := c.dec().Decode()
+	if err != nil {
+		return err
+	}
+
+	return c.handleFrame(f)
+}
+
+// telemetryPool returns the pool passing the queued telemetry to ch, it's closed once the test completes
+func telemetryPool(t *testing.T, ch chan TelemetryMessage) *workerPool {
+	pool := newWorkerPool(&ServerOptions{Workers: 1, QueueSize: 1}, func(j *job) { ch <- j.tm })
+	t.Cleanup(pool.close)
+
+	return pool
+}
+
 var flex10TelemetryArray = "7e41010900000000107df74f5e002b7df74f5e1f78ed019440fd00000000001700d104871001d182c409413333f6423205db383619"
 
 func TestHandleMultipleFlexTelemetryMessage(t *testing.T) {
 	var rw = &bytes.Buffer{}
 	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
-	c := Conn{conn: faker{ReadWriter: rw}, flexBitField: ba, telemetryMessageChan: make(chan TelemetryMessage, 1)}
+	handled := make(chan TelemetryMessage, 1)
+	c := Conn{conn: faker{ReadWriter: rw}, flexBitField: ba, pool: telemetryPool(t, handled)}
 
 	flex10TelemetryArrayBytes, _ := hex.DecodeString(flex10TelemetryArray)
 
-	err := c.handleMultipleFlexTelemetryMessage(MessageTypeArray, flex10TelemetryArrayBytes)
+	err := handleDeviceBytes(&c, rw, flex10TelemetryArrayBytes)
 	if err != nil {
 		t.Errorf("unexpected error processing flex 1.0 telemetry array")
 	}
@@ -90,7 +169,7 @@ func TestHandleMultipleFlexTelemetryMessage(t *testing.T) {
 		t.Errorf("unexpected handshake reply, %x", rw.Bytes())
 	}
 
-	tm := <-c.telemetryMessageChan
+	tm := <-handled
 
 	if !reflect.DeepEqual(tm, TelemetryMessage{
 		Type: MessageTypeArray,
@@ -126,11 +205,12 @@ var flex10TelemetryMessage = "7e540d0000000d000000001004fd4f5e002b04fd4f5e1f78ed
 func TestHandleAlarmingFlexTelemetryMessage(t *testing.T) {
 	var rw = &bytes.Buffer{}
 	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
-	c := Conn{conn: faker{ReadWriter: rw}, flexBitField: ba, telemetryMessageChan: make(chan TelemetryMessage, 1)}
+	handled := make(chan TelemetryMessage, 1)
+	c := Conn{conn: faker{ReadWriter: rw}, flexBitField: ba, pool: telemetryPool(t, handled)}
 
 	flex10TelemetryMessageBytes, _ := hex.DecodeString(flex10TelemetryMessage)
 
-	err := c.handleSingleFlexTelemetryMessage(MessageTypeAlarming, flex10TelemetryMessageBytes)
+	err := handleDeviceBytes(&c, rw, flex10TelemetryMessageBytes)
 	if err != nil {
 		t.Errorf("unexpected error processing flex 1.0 telemetry message")
 	}
@@ -139,7 +219,7 @@ func TestHandleAlarmingFlexTelemetryMessage(t *testing.T) {
 		t.Errorf("unexpected handshake reply, %x", rw.Bytes())
 	}
 
-	tm := <-c.telemetryMessageChan
+	tm := <-handled
 
 	if !reflect.DeepEqual(tm,
 		TelemetryMessage{
@@ -169,3 +249,115 @@ func TestHandleAlarmingFlexTelemetryMessage(t *testing.T) {
 		t.Errorf("unexpected telemetry message, %#v", tm)
 	}
 }
+
+func TestHandleProtocolNegotiation(t *testing.T) {
+	ba, _ := NewBitArrayFromString(strings.Repeat("1", 122))
+
+	for _, tc := range []struct {
+		version, expectedVersion uint8
+		expectedMessageSize      uint16
+	}{
+		{version: flexProtocolVersion20, expectedVersion: flexProtocolVersion20, expectedMessageSize: 403},
+		// unknown higher version falls back to FLEX 2.0
+		{version: 30, expectedVersion: flexProtocolVersion20, expectedMessageSize: 403},
+		// FLEX 1.0 falls back to the first 69 fields of the proposed bit field
+		{version: flexProtocolVersion10, expectedVersion: flexProtocolVersion10, expectedMessageSize: 145},
+	} {
+		var rw = &bytes.Buffer{}
+		c := Conn{conn: faker{ReadWriter: rw}}
+
+		msg := append([]byte("*>FLEX"), 0xb0, tc.version, tc.version, 122)
+		msg = append(msg, ba...)
+		writeDeviceReply(rw, Header{Pre: [4]byte{'@', 'N', 'T', 'C'}}, msg)
+
+		f, err := c.dec().Decode()
+		if err != nil {
+			t.Fatalf("unexpected error decoding protocol negotiation, %v", err)
+		}
+		if err := c.handleFrame(f); err != nil {
+			t.Fatalf("unexpected error during protocol negotiation, %v", err)
+		}
+
+		reply := rw.Bytes()[16:]
+		if !bytes.Equal(reply, append([]byte("*<FLEX"), 0xb0, tc.expectedVersion, tc.expectedVersion)) {
+			t.Errorf("unexpected protocol negotiation reply, %x", reply)
+		}
+
+		if size := c.dec().MessageSize(); size != tc.expectedMessageSize {
+			t.Errorf("unexpected flex message size, %d", size)
+		}
+	}
+}
+
+// sample from the protocol specification, appendix A.3
+var flex20ExtendedTelemetryArray = "7e450139000a251000000030250537d75533ec36d7557e2df9013bcc14010f070000000000000000000000000210120000000000000000000000000000349a"
+
+func TestHandleFlexExtendedTelemetryMessage(t *testing.T) {
+	var rw = &bytes.Buffer{}
+	handled := make(chan ExtendedTelemetryMessage, 1)
+	pool := newWorkerPool(&ServerOptions{Workers: 1, QueueSize: 1}, func(j *job) { handled <- j.etm })
+	t.Cleanup(pool.close)
+	c := Conn{conn: faker{ReadWriter: rw}, pool: pool}
+
+	flex20ExtendedTelemetryArrayBytes, _ := hex.DecodeString(flex20ExtendedTelemetryArray)
+
+	d := NewDecoder(bytes.NewReader(flex20ExtendedTelemetryArrayBytes))
+	f, err := d.Decode()
+	if err == nil {
+		err = c.handleFrame(f)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error processing flex 2.0 extended telemetry array, %v", err)
+	}
+
+	if hex.EncodeToString(rw.Bytes()) != "7e4501"+hex.EncodeToString([]byte{CRC8([]byte{0x7e, 0x45, 0x01})}) {
+		t.Errorf("unexpected extended telemetry array reply, %x", rw.Bytes())
+	}
+
+	tm := <-handled
+
+	if !reflect.DeepEqual(tm, ExtendedTelemetryMessage{
+		Type: MessageTypeExtendedArray,
+		RawExtendedTelemetryMessage: RawExtendedTelemetryMessage{
+			StructVersion: 10,
+			ExtendedTelemetryStaticPart: ExtendedTelemetryStaticPart{
+				SeqNo:                 16,
+				EventCode:             0x2530,
+				Timestamp:             0x55d73705,
+				NavStatus:             0x33,
+				LastValidNavTimestamp: 0x55d736ec,
+				LastValidLat:          0x01f92d7e,
+				LastValidLon:          0x0114cc3b,
+				LastValidAlt:          0x070f,
+			},
+			Fields: []ExtendedField{
+				{Type: ExtendedFieldTypeDriverCard, Data: append([]byte{0x12}, append(make([]byte, 14), 0x34)...)},
+			},
+		},
+	}) {
+		t.Errorf("unexpected extended telemetry message, %#v", tm)
+	}
+
+	// the same record sent as an alarming message
+	msg := append([]byte("~X"), 0x10, 0x00, 0x00, 0x00)
+	msg = append(msg, flex20ExtendedTelemetryArrayBytes[3:len(flex20ExtendedTelemetryArrayBytes)-1]...)
+	msg = append(msg, CRC8(msg))
+
+	rw.Reset()
+	d.Reset(bytes.NewReader(msg))
+	if f, err = d.Decode(); err == nil {
+		err = c.handleFrame(f)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error processing flex 2.0 extended telemetry message, %v", err)
+	}
+
+	if hex.EncodeToString(rw.Bytes()) != "7e5810000000"+hex.EncodeToString([]byte{CRC8([]byte{0x7e, 0x58, 0x10, 0, 0, 0})}) {
+		t.Errorf("unexpected extended telemetry message reply, %x", rw.Bytes())
+	}
+
+	tm = <-handled
+	if tm.Type != MessageTypeExtendedAlarming || tm.SeqNo != 16 {
+		t.Errorf("unexpected extended telemetry message, %#v", tm)
+	}
+}
@@ -0,0 +1,577 @@
+package ntcb
+
+import (
+	"bytes"
+	"io"
+)
+
+var (
+	// ErrUnknownFrame is returned by the decoder when the stream is positioned at a byte which doesn't start
+	// neither NTCB nor FLEX message
+	ErrUnknownFrame = FrameError{Kind: FrameErrorFraming, Msg: "unknown frame", Fatal: true}
+	// ErrUnknownFlexMessage is returned by the decoder when the FLEX message prefix is not recognized, the buffered
+	// data is discarded as the message size is unknown
+	ErrUnknownFlexMessage = framingError("unknown flex message")
+	// ErrGarbageThreshold is returned by the decoder in resync mode when too many bytes are skipped in a row
+	ErrGarbageThreshold = FrameError{Kind: FrameErrorFraming, Msg: "garbage threshold exceeded", Fatal: true}
+	// ErrUnnegotiatedFlexMessage is returned by the decoder when the FLEX telemetry is received before the protocol
+	// negotiation, the buffered data is discarded as the message size is unknown
+	ErrUnnegotiatedFlexMessage = framingError("flex message before protocol negotiation")
+	// ErrExtendedRecordsTooLarge is returned by the decoder when the FLEX 2.0 additional telemetry records claim
+	// more than maxExtendedRecordsSize bytes, the stream can't be decoded further
+	ErrExtendedRecordsTooLarge = FrameError{Kind: FrameErrorFraming, Msg: "extended telemetry records are too large", Fatal: true}
+)
+
+// syncLostError wraps the errors which may be caused by a false frame start, the decoder in resync mode
+// skips such frames byte by byte
+type syncLostError struct {
+	err error
+}
+
+func (e syncLostError) Error() string {
+	return e.err.Error()
+}
+
+const (
+	decoderBufferSize = 4096
+	// maxExtendedRecordsSize bounds the size of the flex 2.0 additional telemetry records of a message, so a
+	// corrupted or hostile size prefix doesn't make the decoder buffer megabytes
+	maxExtendedRecordsSize = 64 << 10
+
+	ntcbPreamble   = "@NTC"
+	ntcbHeaderSize = 16
+	flexPing       = 0x7F
+	flexProtocol   = 0xb0
+)
+
+type FrameType int
+
+const (
+	FrameTypeHandshake FrameType = iota + 1
+	FrameTypeProtocolNegotiation
+	FrameTypeCommandResponse
+	// FrameTypeNTCB is an NTCB message of unrecognized type
+	FrameTypeNTCB
+	FrameTypePing
+	// FrameTypeTelemetry is a FLEX ~T, ~C or ~A message
+	FrameTypeTelemetry
+	// FrameTypeExtendedTelemetry is a FLEX 2.0 ~X or ~E message
+	FrameTypeExtendedTelemetry
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameTypeHandshake:
+		return "handshake"
+	case FrameTypeProtocolNegotiation:
+		return "protocol_negotiation"
+	case FrameTypeCommandResponse:
+		return "command_response"
+	case FrameTypeNTCB:
+		return "ntcb"
+	case FrameTypePing:
+		return "ping"
+	case FrameTypeTelemetry:
+		return "telemetry"
+	case FrameTypeExtendedTelemetry:
+		return "extended_telemetry"
+	}
+
+	return "unknown"
+}
+
+// ProtocolNegotiation is the *>FLEX message proposed by the device
+type ProtocolNegotiation struct {
+	Protocol        uint8
+	ProtocolVersion uint8
+	StructVersion   uint8
+	DataSize        uint8
+	BitField        BitArray
+}
+
+// Frame is a single message decoded from the device stream. Frame returned by the Decoder and the slices it
+// refers to are valid until the next call of Decode.
+type Frame struct {
+	Type FrameType
+	// Raw is the frame as received, including the NTCB header or the FLEX prefix and crc
+	Raw []byte
+
+	// NTCB header and body
+	Header Header
+	Body   []byte
+
+	// DeviceID is the device IMEI sent in the handshake
+	DeviceID    string
+	Negotiation ProtocolNegotiation
+
+	// MessageType of the FLEX telemetry messages
+	MessageType MessageType
+	// EventIndex of the ~T and ~X messages
+	EventIndex                uint32
+	TelemetryMessages         []TelemetryMessage
+	ExtendedTelemetryMessages []ExtendedTelemetryMessage
+}
+
+// Decoder reads frames from the device stream, it keeps the FLEX bit field negotiated in the stream
+// to decode the telemetry records, but never writes replies.
+type Decoder struct {
+	r        io.Reader
+	bitField BitArray
+	plan     *flexPlan
+
+	// buffered stream, buf[off:] is not consumed yet
+	buf []byte
+	off int
+	// size of the last decoded frame, which is consumed by the next Decode call
+	frameSize int
+	frame     Frame
+
+	resync     bool
+	maxGarbage int
+	// bytes skipped since the last decoded frame and in total
+	garbage int
+	skipped int64
+	// bytes read from the stream in total
+	read int64
+	// message type of the FLEX frame the last Decode failed on
+	failedType MessageType
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, buf: make([]byte, 0, decoderBufferSize), plan: newFlexPlan(nil)}
+}
+
+// Reset discards the buffered data and switches the decoder to read from r, negotiated state is kept
+func (d *Decoder) Reset(r io.Reader) {
+	d.r = r
+	d.buf, d.off, d.frameSize, d.garbage = d.buf[:0], 0, 0, 0
+}
+
+// SetBitField sets the FLEX bit field, it's used to decode a stream captured after the protocol negotiation,
+// otherwise the bit field is taken from the decoded *>FLEX message and the server reply passed to ServerReply
+func (d *Decoder) SetBitField(ba BitArray) {
+	d.bitField = append(BitArray(nil), ba...)
+	d.plan = newFlexPlan(d.bitField)
+}
+
+// ServerReply applies the *<FLEX reply the server sent to the device, the bit field proposed by the device is
+// trimmed to the negotiated struct version. The decoder of the device stream never sees the replies, so it's used
+// to decode the recorded sessions.
+func (d *Decoder) ServerReply(b []byte) {
+	if len(b) < ntcbHeaderSize || d.bitField == nil {
+		return
+	}
+
+	// *<FLEX (6) + protocol (1) + protocol version (1) + struct version (1)
+	body := b[ntcbHeaderSize:]
+	if len(body) < 9 || !bytes.HasPrefix(body, []byte("*<FLEX")) {
+		return
+	}
+
+	d.SetBitField(NegotiatedBitField(d.bitField, body[8]))
+}
+
+func (d *Decoder) BitField() BitArray {
+	return d.bitField
+}
+
+// MessageSize returns the size of a single FLEX telemetry record of the negotiated bit field
+func (d *Decoder) MessageSize() uint16 {
+	return d.plan.size
+}
+
+// SetResync enables resynchronization, the decoder skips the bytes which don't start a valid frame instead of
+// failing with ErrUnknownFrame. ErrGarbageThreshold is returned once more than maxGarbage bytes are skipped
+// in a row, zero maxGarbage means no limit.
+func (d *Decoder) SetResync(maxGarbage int) {
+	d.resync, d.maxGarbage = true, maxGarbage
+}
+
+// BytesRead returns the number of bytes read from the stream
+func (d *Decoder) BytesRead() int64 {
+	return d.read
+}
+
+// Skipped returns the number of bytes skipped by the resynchronization
+func (d *Decoder) Skipped() int64 {
+	return d.skipped
+}
+
+// Decode reads the next frame. Frames failed checksum validation are consumed and ErrCheckSumMismatch
+// is returned, so decoding may be continued.
+func (d *Decoder) Decode() (*Frame, error) {
+	d.off += d.frameSize
+	d.frameSize = 0
+
+	for {
+		d.failedType = ""
+		f, size, err := d.decode()
+		if err == nil {
+			d.frameSize, d.garbage = size, 0
+			return f, nil
+		}
+
+		se, lost := err.(syncLostError)
+		if lost {
+			err = se.err
+		}
+		// a false frame start may claim more data than the rest of the stream
+		lost = lost || err == io.ErrUnexpectedEOF
+
+		if !d.resync || !lost {
+			// frame of known size is consumed, the rest of the stream may be decoded
+			d.off += size
+			return nil, err
+		}
+
+		d.skip()
+		if d.maxGarbage > 0 && d.garbage > d.maxGarbage {
+			return nil, ErrGarbageThreshold
+		}
+	}
+}
+
+// skip skips the current byte and the following ones up to the next possible frame start
+func (d *Decoder) skip() {
+	n := 1
+	for _, b := range d.buf[d.off+1:] {
+		if b == '@' || b == '~' || b == flexPing {
+			break
+		}
+		n++
+	}
+
+	d.off += n
+	d.garbage += n
+	d.skipped += int64(n)
+}
+
+// peek returns n bytes of the stream without consuming them, the buffer may be moved, so previously
+// peeked slices must not be used
+func (d *Decoder) peek(n int) ([]byte, error) {
+	if len(d.buf)-d.off >= n {
+		return d.buf[d.off : d.off+n], nil
+	}
+
+	// move the buffered data to the beginning and grow the buffer if the frame doesn't fit
+	if d.off > 0 {
+		d.buf = d.buf[:copy(d.buf, d.buf[d.off:])]
+		d.off = 0
+	}
+	if cap(d.buf) < n {
+		d.buf = append(make([]byte, 0, 2*cap(d.buf)+n), d.buf...)
+	}
+
+	for len(d.buf) < n {
+		m, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+		d.buf = d.buf[:len(d.buf)+m]
+		d.read += int64(m)
+		if err != nil {
+			if len(d.buf) >= n {
+				break
+			}
+			if err == io.EOF && len(d.buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	return d.buf[:n], nil
+}
+
+// buffered returns the number of buffered bytes not consumed yet
+func (d *Decoder) buffered() int {
+	return len(d.buf) - d.off
+}
+
+// decode decodes the frame at the current position without consuming it, size of the frame is returned
+// if it's known even if the frame is invalid
+func (d *Decoder) decode() (*Frame, int, error) {
+	b, err := d.peek(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch b[0] {
+	// NTCB message header
+	case '@':
+		return d.decodeNTCB()
+	// FLEX ping
+	case flexPing:
+		return d.reset(FrameTypePing, b), 1, nil
+	// FLEX message
+	case '~':
+		return d.decodeFlex()
+	}
+
+	return nil, 0, syncLostError{ErrUnknownFrame}
+}
+
+// reset prepares the decoder owned frame, telemetry messages slice is kept to reuse its capacity
+func (d *Decoder) reset(typ FrameType, raw []byte) *Frame {
+	d.frame = Frame{
+		Type:              typ,
+		Raw:               raw,
+		TelemetryMessages: d.frame.TelemetryMessages[:0],
+	}
+
+	return &d.frame
+}
+
+func parseNTCBHeader(b []byte) Header {
+	var h Header
+	copy(h.Pre[:], b)
+	h.IDr = le.Uint32(b[4:])
+	h.IDs = le.Uint32(b[8:])
+	h.N = le.Uint16(b[12:])
+	h.CSd = b[14]
+	h.CSp = b[15]
+
+	return h
+}
+
+func parseNTCBFrameType(body []byte) FrameType {
+	switch {
+	case bytes.HasPrefix(body, []byte("*>S:")):
+		return FrameTypeHandshake
+	case bytes.HasPrefix(body, []byte("*>FLEX")):
+		return FrameTypeProtocolNegotiation
+	case bytes.HasPrefix(body, []byte("*@")), bytes.HasPrefix(body, []byte("*#")):
+		return FrameTypeCommandResponse
+	}
+
+	return FrameTypeNTCB
+}
+
+func (d *Decoder) decodeNTCB() (*Frame, int, error) {
+	b, err := d.peek(ntcbHeaderSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// header is validated before reading the body, so a corrupted size doesn't make to wait for the data
+	// which will never come
+	h := parseNTCBHeader(b)
+	size := ntcbHeaderSize + int(h.N)
+	if h.xor() != h.CSp || (d.resync && string(h.Pre[:]) != ntcbPreamble) {
+		if d.resync {
+			return nil, 0, syncLostError{ErrCheckSumMismatch}
+		}
+
+		// without resync the frame is skipped as a whole, as the header claims
+		if _, err := d.peek(size); err != nil {
+			return nil, 0, err
+		}
+		return nil, size, ErrCheckSumMismatch
+	}
+
+	raw, err := d.peek(size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body := raw[ntcbHeaderSize:]
+	if xor(body) != h.CSd {
+		return nil, size, ErrCheckSumMismatch
+	}
+
+	f := d.reset(parseNTCBFrameType(body), raw)
+	f.Header, f.Body = h, body
+
+	switch f.Type {
+	case FrameTypeHandshake:
+		f.DeviceID = string(body[len("*>S:"):])
+	case FrameTypeProtocolNegotiation:
+		// *>FLEX + protocol (1) + protocol version (1) + struct version (1) + data size (1) + bit field (N)
+		if len(body) < 10 {
+			return nil, size, truncatedError("protocol negotiation message is too short")
+		}
+
+		// bit field holds a bit per field of the data size
+		if len(body) < 10+(int(body[9])+7)/8 {
+			return nil, size, truncatedError("protocol negotiation bit field is too short")
+		}
+
+		f.Negotiation = ProtocolNegotiation{
+			Protocol:        body[6],
+			ProtocolVersion: body[7],
+			StructVersion:   body[8],
+			DataSize:        body[9],
+			BitField:        append(BitArray(nil), body[10:]...),
+		}
+
+		if f.Negotiation.Protocol == flexProtocol {
+			d.SetBitField(f.Negotiation.BitField)
+		}
+	}
+
+	return f, size, nil
+}
+
+// extendedRecordsSize returns the size of the size prefixed flex 2.0 additional telemetry records at the offset
+func (d *Decoder) extendedRecordsSize(offset int, count int) (int, error) {
+	size := 0
+	for i := 0; i < count; i++ {
+		// record size (2)
+		b, err := d.peek(offset + size + 2)
+		if err != nil {
+			return 0, err
+		}
+
+		size += 2 + int(le.Uint16(b[len(b)-2:]))
+		if size > maxExtendedRecordsSize {
+			// may be a false frame start as well
+			return 0, syncLostError{ErrExtendedRecordsTooLarge}
+		}
+	}
+
+	return size, nil
+}
+
+func (d *Decoder) decodeFlex() (*Frame, int, error) {
+	fp, err := d.peek(2)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// records size is known once the bit field is negotiated
+	recordSize := 0
+	switch string(fp) {
+	case "~T", "~C", "~A":
+		if d.bitField == nil {
+			return nil, d.buffered(), syncLostError{ErrUnnegotiatedFlexMessage}
+		}
+		recordSize = int(d.plan.size)
+	}
+
+	var typ MessageType
+	var size int
+	switch string(fp) {
+	case "~T":
+		// header (2) + event index (4) + flex message (N) + crc (1)
+		typ, size = MessageTypeAlarming, 2+4+recordSize+1
+	case "~C":
+		// header (2) + flex message (N) + crc (1)
+		typ, size = MessageTypeCurrent, 2+recordSize+1
+	case "~A":
+		prefixBytes, err := d.peek(3)
+		if err != nil {
+			return nil, 0, err
+		}
+		// header (2) + size (1) + flex message (N) * size + crc (1)
+		typ, size = MessageTypeArray, 2+1+recordSize*int(prefixBytes[2])+1
+	case "~X":
+		// header (2) + event index (4) + extended message (N) + crc (1)
+		recordsSize, err := d.extendedRecordsSize(2+4, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ, size = MessageTypeExtendedAlarming, 2+4+recordsSize+1
+	case "~E":
+		// header (2) + count (1) + extended message (N) * count + crc (1)
+		prefixBytes, err := d.peek(3)
+		if err != nil {
+			return nil, 0, err
+		}
+		recordsSize, err := d.extendedRecordsSize(2+1, int(prefixBytes[2]))
+		if err != nil {
+			return nil, 0, err
+		}
+		typ, size = MessageTypeExtendedArray, 2+1+recordsSize+1
+	default:
+		// size of the unknown message is not known, so everything buffered is dropped
+		return nil, d.buffered(), syncLostError{ErrUnknownFlexMessage}
+	}
+
+	raw, err := d.peek(size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if CRC8(raw[:len(raw)-1]) != raw[len(raw)-1] {
+		d.failedType = typ
+		return nil, size, syncLostError{ErrCheckSumMismatch}
+	}
+
+	f, err := d.decodeFlexFrame(typ, raw)
+	if err != nil {
+		d.failedType = typ
+	}
+	return f, size, err
+}
+
+// decodeFlexFrame decodes the complete FLEX message of the given type, its checksum is validated by the framing
+func (d *Decoder) decodeFlexFrame(typ MessageType, raw []byte) (*Frame, error) {
+	if len(raw) < 3 {
+		return nil, truncatedError("flex message is too short")
+	}
+
+	body := raw[2 : len(raw)-1]
+
+	switch typ {
+	case MessageTypeAlarming, MessageTypeCurrent, MessageTypeArray:
+		if d.bitField == nil {
+			return nil, ErrUnnegotiatedFlexMessage
+		}
+
+		f := d.reset(FrameTypeTelemetry, raw)
+		f.MessageType = typ
+
+		// current state message has no event index
+		count := 1
+		switch typ {
+		case MessageTypeAlarming:
+			if len(body) < 4 {
+				return nil, truncatedError("telemetry message is too short")
+			}
+			f.EventIndex, body = le.Uint32(body), body[4:]
+		case MessageTypeArray:
+			if len(body) < 1 {
+				return nil, truncatedError("telemetry message is too short")
+			}
+			count, body = int(body[0]), body[1:]
+		}
+
+		for i := 0; i < count; i++ {
+			// decode into the decoder owned messages to avoid allocation
+			f.TelemetryMessages = append(f.TelemetryMessages, TelemetryMessage{Type: typ})
+			if err := d.plan.decode(body, &f.TelemetryMessages[i].RawTelemetryMessage); err != nil {
+				return nil, err
+			}
+			body = body[d.plan.size:]
+		}
+
+		return f, nil
+	case MessageTypeExtendedAlarming, MessageTypeExtendedArray:
+		f := d.reset(FrameTypeExtendedTelemetry, raw)
+		f.MessageType = typ
+
+		count := 1
+		if typ == MessageTypeExtendedAlarming {
+			if len(body) < 4 {
+				return nil, truncatedError("extended telemetry message is too short")
+			}
+			f.EventIndex, body = le.Uint32(body), body[4:]
+		} else {
+			if len(body) < 1 {
+				return nil, truncatedError("extended telemetry message is too short")
+			}
+			count, body = int(body[0]), body[1:]
+		}
+
+		r := bytes.NewReader(body)
+		for i := 0; i < count; i++ {
+			te, err := readExtendedTelemetryMessage(r)
+			if err != nil {
+				return nil, err
+			}
+
+			f.ExtendedTelemetryMessages = append(f.ExtendedTelemetryMessages, ExtendedTelemetryMessage{Type: typ, RawExtendedTelemetryMessage: *te})
+		}
+
+		return f, nil
+	}
+
+	return nil, ErrUnknownFlexMessage
+}
@@ -0,0 +1,172 @@
+package ntcb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestDecoderSession(t *testing.T) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	handshakeBytes, _ := hex.DecodeString(handshake)
+	arrayBytes, _ := hex.DecodeString(flex10TelemetryArray)
+	alarmingBytes, _ := hex.DecodeString(flex10TelemetryMessage)
+
+	var session bytes.Buffer
+	session.Write(handshakeBytes)
+	negotiation := append([]byte("*>FLEX"), 0xb0, flexProtocolVersion10, flexProtocolVersion10, 72)
+	writeDeviceReply(&session, Header{Pre: [4]byte{'@', 'N', 'T', 'C'}}, append(negotiation, ba...))
+	session.Write(arrayBytes)
+	session.WriteByte(flexPing)
+	// corrupted crc, the message is skipped
+	session.Write(append(append([]byte(nil), alarmingBytes[:len(alarmingBytes)-1]...), 0))
+	session.Write(alarmingBytes)
+
+	d := NewDecoder(&session)
+
+	f, err := d.Decode()
+	if err != nil || f.Type != FrameTypeHandshake || f.DeviceID != "100000000000000" {
+		t.Fatalf("unexpected handshake frame %+v, %v", f, err)
+	}
+
+	f, err = d.Decode()
+	if err != nil || f.Type != FrameTypeProtocolNegotiation || f.Negotiation.DataSize != 72 {
+		t.Fatalf("unexpected protocol negotiation frame %+v, %v", f, err)
+	}
+	if !bytes.Equal(d.BitField(), ba) || d.MessageSize() != 49 {
+		t.Errorf("unexpected negotiated state, %x, %d", d.BitField(), d.MessageSize())
+	}
+
+	f, err = d.Decode()
+	if err != nil || f.Type != FrameTypeTelemetry || f.MessageType != MessageTypeArray || len(f.TelemetryMessages) != 1 {
+		t.Fatalf("unexpected telemetry array frame %+v, %v", f, err)
+	}
+	if tm := f.TelemetryMessages[0]; tm.SeqNo != 0x9 || tm.CANSpeed != 0x36 {
+		t.Errorf("unexpected telemetry message, %#v", tm)
+	}
+
+	if f, err = d.Decode(); err != nil || f.Type != FrameTypePing {
+		t.Fatalf("unexpected ping frame %+v, %v", f, err)
+	}
+
+	if _, err = d.Decode(); err != ErrCheckSumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	f, err = d.Decode()
+	if err != nil || f.Type != FrameTypeTelemetry || f.MessageType != MessageTypeAlarming || f.EventIndex != 0xd {
+		t.Fatalf("unexpected alarming telemetry frame %+v, %v", f, err)
+	}
+	if !bytes.Equal(f.Raw, alarmingBytes) || f.TelemetryMessages[0].SeqNo != 0xd {
+		t.Errorf("unexpected alarming telemetry message, %#v", f.TelemetryMessages[0])
+	}
+
+	if _, err = d.Decode(); err != io.EOF {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+}
+
+func TestDecoderUnknownFrame(t *testing.T) {
+	d := NewDecoder(bytes.NewReader([]byte("~Z123")))
+	if _, err := d.Decode(); err != ErrUnknownFlexMessage {
+		t.Errorf("expected unknown flex message, got %v", err)
+	}
+
+	d.Reset(bytes.NewReader([]byte("GET / HTTP/1.1")))
+	if _, err := d.Decode(); err != ErrUnknownFrame {
+		t.Errorf("expected unknown frame, got %v", err)
+	}
+}
+
+func TestDecoderResync(t *testing.T) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	handshakeBytes, _ := hex.DecodeString(handshake)
+	alarmingBytes, _ := hex.DecodeString(flex10TelemetryMessage)
+
+	var session bytes.Buffer
+	session.WriteString("GET")
+	session.Write(handshakeBytes)
+	// false frame starts inside the garbage
+	session.WriteString("@NT~A~T")
+	session.WriteByte(flexPing)
+	// corrupted crc, the message is skipped up to the next frame start
+	session.Write(append(append([]byte(nil), alarmingBytes[:len(alarmingBytes)-1]...), 0))
+	session.Write(alarmingBytes)
+
+	d := NewDecoder(&session)
+	d.SetBitField(ba)
+	d.SetResync(0)
+
+	f, err := d.Decode()
+	if err != nil || f.Type != FrameTypeHandshake || d.Skipped() != 3 {
+		t.Fatalf("unexpected handshake frame %+v, %v, skipped %d", f, err, d.Skipped())
+	}
+
+	if f, err = d.Decode(); err != nil || f.Type != FrameTypePing || d.Skipped() != 10 {
+		t.Fatalf("unexpected ping frame %+v, %v, skipped %d", f, err, d.Skipped())
+	}
+
+	f, err = d.Decode()
+	if err != nil || f.Type != FrameTypeTelemetry || !bytes.Equal(f.Raw, alarmingBytes) {
+		t.Fatalf("unexpected alarming telemetry frame %+v, %v", f, err)
+	}
+	if d.Skipped() != int64(10+len(alarmingBytes)) {
+		t.Errorf("unexpected number of skipped bytes, %d", d.Skipped())
+	}
+
+	if _, err = d.Decode(); err != io.EOF {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+}
+
+func TestDecoderGarbageThreshold(t *testing.T) {
+	handshakeBytes, _ := hex.DecodeString(handshake)
+
+	d := NewDecoder(bytes.NewReader(append([]byte("GET / HTTP/1.1\r\n"), handshakeBytes...)))
+	d.SetResync(8)
+	if _, err := d.Decode(); err != ErrGarbageThreshold {
+		t.Errorf("expected garbage threshold exceeded, got %v", err)
+	}
+
+	d.Reset(bytes.NewReader(append([]byte("GET / HTTP/1.1\r\n"), handshakeBytes...)))
+	d.SetResync(16)
+	if f, err := d.Decode(); err != nil || f.Type != FrameTypeHandshake {
+		t.Errorf("unexpected handshake frame %+v, %v", f, err)
+	}
+}
+
+func TestDecoderMalformedFrames(t *testing.T) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	e := NewEncoder(ba)
+	var tm RawTelemetryMessage
+
+	tests := []struct {
+		name  string
+		data  []byte
+		kind  FrameErrorKind
+		fatal bool
+	}{
+		{name: "unknown frame", data: []byte("GET / HTTP/1.1"), kind: FrameErrorFraming, fatal: true},
+		{name: "flex before negotiation", data: e.Current(&tm), kind: FrameErrorFraming},
+		{name: "corrupted checksum", data: append(e.Handshake("100000000000000")[:ntcbHeaderSize+4], "200000000000000"...), kind: FrameErrorChecksum},
+		{name: "short negotiation", data: e.NTCBMessage([]byte("*>FLEX")), kind: FrameErrorTruncated},
+		{name: "short bit field", data: e.NTCBMessage(append([]byte("*>FLEX"), flexProtocol, 10, 10, 72, 0xff)), kind: FrameErrorTruncated},
+		{name: "short extended record", data: appendCRC8([]byte("~X\x01\x00\x00\x00\x01\x00\x0a")), kind: FrameErrorTruncated},
+		{name: "oversized extended records", data: []byte("~E\xff\xff\xff"), kind: FrameErrorFraming, fatal: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder(bytes.NewReader(tt.data)).Decode()
+			fe, ok := err.(FrameError)
+			if !ok || fe.Kind != tt.kind || fe.Fatal != tt.fatal || IsNTCBDataExchangeError(err) == tt.fatal {
+				t.Errorf("unexpected error %#v", err)
+			}
+		})
+	}
+}
+
+func appendCRC8(b []byte) []byte {
+	return append(b, CRC8(b))
+}
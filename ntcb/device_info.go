@@ -0,0 +1,82 @@
+package ntcb
+
+import (
+	"context"
+	"strings"
+)
+
+var (
+	// CommandVersion requests the device model and firmware version, which device replies with
+	// *#V:<model>:<version>:<date>:<language>
+	CommandVersion = Command("*?V")
+	// CommandICCID requests the SIM card serial number, which device replies with *#ICCID:<id>
+	CommandICCID = Command("*?ICCID")
+)
+
+type DeviceInfo struct {
+	Model            string
+	FirmwareVersion  string
+	FirmwareDate     string
+	FirmwareLanguage string
+	ICCID            string
+}
+
+func parseVersionReply(body []byte) (DeviceInfo, error) {
+	// *#V:E-1110:01.00.53:07.02.08:RU
+	parts := strings.Split(strings.TrimRight(string(body), "\x00\r\n"), ":")
+	if len(parts) != 5 || parts[0] != "*#V" {
+		return DeviceInfo{}, DataExchangeError("invalid version reply")
+	}
+
+	return DeviceInfo{
+		Model:            strings.TrimSpace(parts[1]),
+		FirmwareVersion:  parts[2],
+		FirmwareDate:     parts[3],
+		FirmwareLanguage: parts[4],
+	}, nil
+}
+
+func parseICCIDReply(body []byte) (string, error) {
+	s := strings.TrimRight(string(body), "\x00\r\n")
+	if !strings.HasPrefix(s, "*#ICCID:") {
+		return "", DataExchangeError("invalid ICCID reply")
+	}
+
+	return s[len("*#ICCID:"):], nil
+}
+
+// RequestDeviceInfo requests the device model, firmware version and SIM card serial number, the serial number
+// is left empty if the device does not provide it. The result is available with DeviceInfo afterwards.
+func (c *Conn) RequestDeviceInfo(ctx context.Context) (DeviceInfo, error) {
+	reply, err := c.SendCommand(ctx, CommandVersion)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	info, err := parseVersionReply(reply)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	if reply, err := c.SendCommand(ctx, CommandICCID); err == nil {
+		info.ICCID, _ = parseICCIDReply(reply)
+	}
+
+	c.infoMu.Lock()
+	c.info = &info
+	c.infoMu.Unlock()
+
+	return info, nil
+}
+
+// DeviceInfo returns the device info received by the last successful RequestDeviceInfo call
+func (c *Conn) DeviceInfo() (DeviceInfo, bool) {
+	c.infoMu.Lock()
+	defer c.infoMu.Unlock()
+
+	if c.info == nil {
+		return DeviceInfo{}, false
+	}
+
+	return *c.info, true
+}
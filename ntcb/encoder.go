@@ -0,0 +1,126 @@
+package ntcb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+)
+
+// DefaultDeviceHeader addresses device messages to the server 1 from the device 0
+var DefaultDeviceHeader = Header{Pre: [4]byte{'@', 'N', 'T', 'C'}, IDr: 1}
+
+// Encoder builds the frames sent by the device, it's the counterpart of the Decoder used by tools and tests.
+// Returned frames are newly allocated and carry valid checksums.
+type Encoder struct {
+	// Header addresses the NTCB messages, N and checksums are calculated by the encoder
+	Header Header
+
+	bitField BitArray
+	plan     *flexPlan
+}
+
+func NewEncoder(ba BitArray) *Encoder {
+	e := &Encoder{Header: DefaultDeviceHeader}
+	e.SetBitField(ba)
+
+	return e
+}
+
+// SetBitField sets the FLEX bit field the telemetry records are encoded with
+func (e *Encoder) SetBitField(ba BitArray) {
+	e.bitField = append(BitArray(nil), ba...)
+	e.plan = newFlexPlan(e.bitField)
+}
+
+func (e *Encoder) BitField() BitArray {
+	return e.bitField
+}
+
+// NTCBMessage builds the NTCB message of the given body
+func (e *Encoder) NTCBMessage(body []byte) []byte {
+	return appendNTCBMessage(nil, e.Header, body)
+}
+
+// Handshake builds the *>S handshake message of the device IMEI
+func (e *Encoder) Handshake(imei string) []byte {
+	return e.NTCBMessage([]byte("*>S:" + imei))
+}
+
+// ProtocolNegotiation builds the *>FLEX message proposing the FLEX versions and the encoder bit field,
+// data size is the number of the bit field meaningful bits
+func (e *Encoder) ProtocolNegotiation(protocolVersion, structVersion, dataSize uint8) []byte {
+	body := append([]byte("*>FLEX"), flexProtocol, protocolVersion, structVersion, dataSize)
+
+	return e.NTCBMessage(append(body, e.bitField...))
+}
+
+// Ping builds the FLEX ping
+func (e *Encoder) Ping() []byte {
+	return []byte{flexPing}
+}
+
+// Record builds a single telemetry record of the fields set in the bit field
+func (e *Encoder) Record(tm *RawTelemetryMessage) []byte {
+	return e.plan.encode(make([]byte, 0, e.plan.size), tm)
+}
+
+// Alarming builds the ~T message
+func (e *Encoder) Alarming(eventIndex uint32, tm *RawTelemetryMessage) []byte {
+	b := make([]byte, 0, 2+4+int(e.plan.size)+1)
+	b = append(b, '~', 'T', 0, 0, 0, 0)
+	le.PutUint32(b[2:], eventIndex)
+	b = e.plan.encode(b, tm)
+
+	return append(b, CRC8(b))
+}
+
+// Current builds the ~C message
+func (e *Encoder) Current(tm *RawTelemetryMessage) []byte {
+	b := make([]byte, 0, 2+int(e.plan.size)+1)
+	b = append(b, '~', 'C')
+	b = e.plan.encode(b, tm)
+
+	return append(b, CRC8(b))
+}
+
+// Array builds the ~A message, it carries 255 records at most
+func (e *Encoder) Array(tms []RawTelemetryMessage) []byte {
+	if len(tms) > 255 {
+		tms = tms[:255]
+	}
+
+	b := make([]byte, 0, 2+1+int(e.plan.size)*len(tms)+1)
+	b = append(b, '~', 'A', uint8(len(tms)))
+	for i := range tms {
+		b = e.plan.encode(b, &tms[i])
+	}
+
+	return append(b, CRC8(b))
+}
+
+// encode appends the telemetry record to dst, the struct field of the same index is written for every FLEX field
+func (p *flexPlan) encode(dst []byte, tm *RawTelemetryMessage) []byte {
+	buf := bytes.NewBuffer(dst)
+	v := reflect.ValueOf(tm).Elem()
+	for _, f := range p.fields {
+		_ = binary.Write(buf, binary.LittleEndian, v.Field(f.index).Interface())
+	}
+
+	return buf.Bytes()
+}
+
+// appendNTCBMessage appends the NTCB message to dst, body size and checksums are set in the header
+func appendNTCBMessage(dst []byte, h Header, body []byte) []byte {
+	h.N = uint16(len(body))
+	h.CSd = xor(body)
+	h.CSp = h.xor()
+
+	var hb [ntcbHeaderSize]byte
+	copy(hb[:], h.Pre[:])
+	le.PutUint32(hb[4:], h.IDr)
+	le.PutUint32(hb[8:], h.IDs)
+	le.PutUint16(hb[12:], h.N)
+	hb[14], hb[15] = h.CSd, h.CSp
+
+	return append(append(dst, hb[:]...), body...)
+}
@@ -0,0 +1,77 @@
+package ntcb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestEncoderMatchesDeviceTraffic(t *testing.T) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	e := NewEncoder(ba)
+
+	if h := hex.EncodeToString(e.Handshake("100000000000000")); h != handshake {
+		t.Errorf("unexpected handshake, %s", h)
+	}
+
+	arrayBytes, _ := hex.DecodeString(flex10TelemetryArray)
+	alarmingBytes, _ := hex.DecodeString(flex10TelemetryMessage)
+
+	d := NewDecoder(bytes.NewReader(append(append([]byte(nil), arrayBytes...), alarmingBytes...)))
+	d.SetBitField(ba)
+
+	f, err := d.Decode()
+	if err != nil {
+		t.Fatalf("unexpected error decoding telemetry array, %v", err)
+	}
+	if b := e.Array([]RawTelemetryMessage{f.TelemetryMessages[0].RawTelemetryMessage}); !bytes.Equal(b, arrayBytes) {
+		t.Errorf("unexpected telemetry array, %x", b)
+	}
+
+	if f, err = d.Decode(); err != nil {
+		t.Fatalf("unexpected error decoding alarming telemetry message, %v", err)
+	}
+	if b := e.Alarming(f.EventIndex, &f.TelemetryMessages[0].RawTelemetryMessage); !bytes.Equal(b, alarmingBytes) {
+		t.Errorf("unexpected alarming telemetry message, %x", b)
+	}
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	ba, _ := NewBitArrayFromString(strings.Repeat("1", FlexFieldCount))
+	e := NewEncoder(ba)
+
+	record := make([]byte, e.plan.size)
+	rand.New(rand.NewSource(1)).Read(record)
+
+	var tm RawTelemetryMessage
+	if err := e.plan.decode(record, &tm); err != nil {
+		t.Fatalf("unexpected error decoding record, %v", err)
+	}
+	if b := e.Record(&tm); !bytes.Equal(b, record) {
+		t.Fatalf("encoded record differs from the decoded one")
+	}
+
+	var session bytes.Buffer
+	session.Write(e.Handshake("100000000000000"))
+	session.Write(e.ProtocolNegotiation(flexProtocolVersion20, flexProtocolVersion20, FlexFieldCount))
+	session.Write(e.Ping())
+	session.Write(e.Current(&tm))
+	session.Write(e.Array([]RawTelemetryMessage{tm, tm}))
+
+	d := NewDecoder(&session)
+	for _, expected := range []FrameType{FrameTypeHandshake, FrameTypeProtocolNegotiation, FrameTypePing} {
+		if f, err := d.Decode(); err != nil || f.Type != expected {
+			t.Fatalf("unexpected frame %+v, %v", f, err)
+		}
+	}
+
+	if f, err := d.Decode(); err != nil || f.MessageType != MessageTypeCurrent || !bytes.Equal(e.Record(&f.TelemetryMessages[0].RawTelemetryMessage), record) {
+		t.Fatalf("unexpected current state frame %+v, %v", f, err)
+	}
+
+	if f, err := d.Decode(); err != nil || f.MessageType != MessageTypeArray || len(f.TelemetryMessages) != 2 {
+		t.Fatalf("unexpected telemetry array frame %+v, %v", f, err)
+	}
+}
@@ -0,0 +1,137 @@
+package ntcb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	MessageTypeExtendedAlarming MessageType = "extended_alarming"
+	MessageTypeExtendedArray    MessageType = "extended_array"
+)
+
+type ExtendedFieldType uint8
+
+const (
+	ExtendedFieldTypeTouchMemoryKey ExtendedFieldType = 0x01
+	ExtendedFieldTypeDriverCard     ExtendedFieldType = 0x02
+	ExtendedFieldTypeRFIDCode       ExtendedFieldType = 0x03
+)
+
+// ExtendedTelemetryMessage is the FLEX 2.0 additional telemetry record sent in ~X and ~E messages
+type ExtendedTelemetryMessage struct {
+	Type MessageType
+	RawExtendedTelemetryMessage
+}
+
+type RawExtendedTelemetryMessage struct {
+	StructVersion uint8
+	ExtendedTelemetryStaticPart
+	Fields []ExtendedField
+}
+
+type ExtendedTelemetryStaticPart struct {
+	SeqNo                 uint32
+	EventCode             uint16
+	Timestamp             uint32
+	NavStatus             uint8
+	LastValidNavTimestamp uint32
+	LastValidLat          int32
+	LastValidLon          int32
+	LastValidAlt          int32
+	Speed                 float32
+	Direction             uint16
+	Odometer              float32
+}
+
+type ExtendedField struct {
+	Type ExtendedFieldType
+	Data []byte
+}
+
+func (tm *RawExtendedTelemetryMessage) GetNavStatusSatelliteCount() uint8 {
+	return tm.NavStatus >> 2
+}
+
+func (tm *RawExtendedTelemetryMessage) IsNavStatusValid() bool {
+	return tm.NavStatus&0b00000010 > 0
+}
+
+func (tm *RawExtendedTelemetryMessage) field(typ ExtendedFieldType, size int) ([]byte, bool) {
+	for _, f := range tm.Fields {
+		if f.Type == typ && len(f.Data) >= size {
+			return f.Data[:size], true
+		}
+	}
+
+	return nil, false
+}
+
+func (tm *RawExtendedTelemetryMessage) GetTouchMemoryKey() (uint64, bool) {
+	d, ok := tm.field(ExtendedFieldTypeTouchMemoryKey, 8)
+	if !ok {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint64(d), true
+}
+
+func (tm *RawExtendedTelemetryMessage) GetDriverCard() ([]byte, bool) {
+	return tm.field(ExtendedFieldTypeDriverCard, 16)
+}
+
+func (tm *RawExtendedTelemetryMessage) GetRFIDCode() (uint64, bool) {
+	d, ok := tm.field(ExtendedFieldTypeRFIDCode, 8)
+	if !ok {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint64(d), true
+}
+
+// readExtendedTelemetryMessage reads a single additional telemetry record, which is prefixed with its size
+func readExtendedTelemetryMessage(r io.Reader) (*RawExtendedTelemetryMessage, error) {
+	var recordSize uint16
+	if err := binary.Read(r, binary.LittleEndian, &recordSize); err != nil {
+		return nil, truncatedError("extended telemetry record size is missing")
+	}
+
+	record := make([]byte, recordSize)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, truncatedError("extended telemetry record is too short")
+	}
+
+	// struct version (1) + static part size (1)
+	if len(record) < 2 {
+		return nil, truncatedError("extended telemetry record is too short")
+	}
+
+	var tm RawExtendedTelemetryMessage
+	tm.StructVersion = record[0]
+	staticPartSize := int(record[1])
+	if staticPartSize < binary.Size(tm.ExtendedTelemetryStaticPart) || 2+staticPartSize > len(record) {
+		return nil, framingError("invalid extended telemetry static part size")
+	}
+
+	if err := binary.Read(bytes.NewReader(record[2:]), binary.LittleEndian, &tm.ExtendedTelemetryStaticPart); err != nil {
+		return nil, truncatedError("extended telemetry static part is too short")
+	}
+
+	// dynamic part consists of type (1) + size (1) + data (N) fields
+	dynamicPart := record[2+staticPartSize:]
+	for len(dynamicPart) > 0 {
+		if len(dynamicPart) < 2 || 2+int(dynamicPart[1]) > len(dynamicPart) {
+			return nil, framingError("invalid extended telemetry dynamic part")
+		}
+
+		fieldSize := int(dynamicPart[1])
+		tm.Fields = append(tm.Fields, ExtendedField{
+			Type: ExtendedFieldType(dynamicPart[0]),
+			Data: dynamicPart[2 : 2+fieldSize],
+		})
+		dynamicPart = dynamicPart[2+fieldSize:]
+	}
+
+	return &tm, nil
+}
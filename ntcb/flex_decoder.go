@@ -0,0 +1,238 @@
+package ntcb
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+var le = binary.LittleEndian
+
+type flexField struct {
+	size   uint16
+	decode func(tm *RawTelemetryMessage, b []byte)
+}
+
+// flexFields describes every FLEX telemetry record field in the order of the bit field
+var flexFields = [FlexFieldCount]flexField{
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.SeqNo = le.Uint32(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.EventCode = le.Uint16(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.Timestamp = le.Uint32(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.Status = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.FuncModuleStatus1 = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.FuncModuleStatus2 = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.GSMLevel = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.NavStatus = b[0] }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.LatValidNavTimestamp = le.Uint32(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.LastValidLat = le.Uint32(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.LastValidLon = le.Uint32(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.LastValidAlt = le.Uint32(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.Speed = math.Float32frombits(le.Uint32(b)) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.Direction = le.Uint16(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.Odometer = math.Float32frombits(le.Uint32(b)) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.LastLegDistance = math.Float32frombits(le.Uint32(b)) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.LastLegDurationSec = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.LastLegDurationSec2 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.MainBatteryVoltage = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.SecondaryBatteryVoltage = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage1 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage2 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage3 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage4 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage5 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage6 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage7 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueInVoltage8 = le.Uint16(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.DiscreteSensor1 = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.DiscreteSensor2 = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.OutputState1 = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.OutputState2 = b[0] }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.ImpulseCounter1 = le.Uint32(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.ImpulseCounter2 = le.Uint32(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueSensorFreq1 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AnalogueSensorFreq2 = le.Uint16(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.MotoHoursSec = le.Uint32(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor1 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor2 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor3 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor4 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor5 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor6 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RS232FuelSensor = le.Uint16(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor1 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor2 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor3 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor4 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor5 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor6 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor7 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TempDiscreteSensor8 = int8(b[0]) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CANFuelLevel = le.Uint16(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.CANFuelConsumption = math.Float32frombits(le.Uint32(b)) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CanEngineRPM = le.Uint16(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.CANEngineCoolerTemp = int8(b[0]) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.CANOdometer = math.Float32frombits(le.Uint32(b)) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CANAxisLoad1 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CANAxisLoad2 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CANAxisLoad3 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CANAxisLoad4 = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CANAxisLoad5 = le.Uint16(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.CANAccelerometerPosition = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.CANBrakePosition = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.CANEngineLoad = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.CANDieselGasFilterFluidLevel = b[0] }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.CANEngineFullWorkTimeSec = le.Uint32(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.CANDistanceUntilService = int16(le.Uint16(b)) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.CANSpeed = b[0] }},
+
+	// FLEX 2.0
+	{8, func(tm *RawTelemetryMessage, b []byte) { tm.NavSatellites = decodeNavSatellites(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.DOP = DOP{HDOP: b[0], PDOP: b[1]} }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.HPNavStatus = b[0] }},
+	{16, func(tm *RawTelemetryMessage, b []byte) { tm.HPCoordinates = decodeHPCoordinates(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.HPAlt = int32(le.Uint32(b)) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.HPDirection = le.Uint16(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.HPSpeed = math.Float32frombits(le.Uint32(b)) }},
+	{37, func(tm *RawTelemetryMessage, b []byte) { tm.LBS = decodeLBS(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensorTemp1 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensorTemp2 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensorTemp3 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensorTemp4 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensorTemp5 = int8(b[0]) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensorTemp6 = int8(b[0]) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor7 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor8 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor9 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor10 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor11 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor12 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor13 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor14 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor15 = decodeFuelSensor(b) }},
+	{3, func(tm *RawTelemetryMessage, b []byte) { tm.RS485FuelSensor16 = decodeFuelSensor(b) }},
+	{6, func(tm *RawTelemetryMessage, b []byte) { decodeTirePressureSensors(tm.TirePressureSensors1[:], b) }},
+	{12, func(tm *RawTelemetryMessage, b []byte) { decodeTirePressureSensors(tm.TirePressureSensors2[:], b) }},
+	{24, func(tm *RawTelemetryMessage, b []byte) { decodeTirePressureSensors(tm.TirePressureSensors3[:], b) }},
+	{48, func(tm *RawTelemetryMessage, b []byte) { decodeTirePressureSensors(tm.TirePressureSensors4[:], b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TachographDriverActivity = b[0] }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TachographMode = b[0] }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.TachographStatus = le.Uint16(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.TachographSpeed = b[0] }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.TachographOdometer = le.Uint32(b) }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.TachographTimestamp = le.Uint32(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.DisplayDriverState = b[0] }},
+	{4, func(tm *RawTelemetryMessage, b []byte) { tm.DisplayLastMessageIndex = le.Uint32(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.TimeIncrement = le.Uint16(b) }},
+	{6, func(tm *RawTelemetryMessage, b []byte) { tm.Acceleration = decodeAcceleration(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.AccelerationModule = int16(le.Uint16(b)) }},
+	{6, func(tm *RawTelemetryMessage, b []byte) { tm.AccelerationMax = decodeAccelerationMax(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters1 = [2]uint8{b[0], b[1]} }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters2 = [2]uint8{b[0], b[1]} }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters3 = [2]uint8{b[0], b[1]} }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters4 = [2]uint8{b[0], b[1]} }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters5 = [2]uint8{b[0], b[1]} }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters6 = [2]uint8{b[0], b[1]} }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters7 = [2]uint8{b[0], b[1]} }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.PassengerCounters8 = [2]uint8{b[0], b[1]} }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.AutoinformerStatus = b[0] }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.LastGeofenceID = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.LastStopID = le.Uint16(b) }},
+	{2, func(tm *RawTelemetryMessage, b []byte) { tm.RouteID = le.Uint16(b) }},
+	{1, func(tm *RawTelemetryMessage, b []byte) { tm.CameraStatus = b[0] }},
+}
+
+// flexPlan is a precomputed list of fields enabled by the negotiated bit field along with their offsets
+// in the telemetry record, which allows to decode records without reflection
+type flexPlan struct {
+	fields []flexPlanField
+	size   uint16
+}
+
+type flexPlanField struct {
+	// index of the field in the bit field and in RawTelemetryMessage
+	index  int
+	offset uint16
+	*flexField
+}
+
+func newFlexPlan(ba BitArray) *flexPlan {
+	p := &flexPlan{}
+	for i := range flexFields {
+		if ba.IsSet(i) {
+			p.fields = append(p.fields, flexPlanField{index: i, offset: p.size, flexField: &flexFields[i]})
+			p.size += flexFields[i].size
+		}
+	}
+
+	return p
+}
+
+// decode decodes a single telemetry record from the beginning of b
+func (p *flexPlan) decode(b []byte, tm *RawTelemetryMessage) error {
+	if len(b) < int(p.size) {
+		return truncatedError("telemetry record is too short")
+	}
+
+	for _, f := range p.fields {
+		f.decode(tm, b[f.offset:])
+	}
+
+	return nil
+}
+
+func decodeNavSatellites(b []byte) NavSatellites {
+	return NavSatellites{
+		GLONASS: b[0],
+		GPS:     b[1],
+		Galileo: b[2],
+		Compass: b[3],
+		Beidou:  b[4],
+		DORIS:   b[5],
+		IRNSS:   b[6],
+		QZSS:    b[7],
+	}
+}
+
+func decodeHPCoordinates(b []byte) HPCoordinates {
+	return HPCoordinates{Lat: int64(le.Uint64(b)), Lon: int64(le.Uint64(b[8:]))}
+}
+
+func decodeBaseStation(b []byte) BaseStation {
+	return BaseStation{
+		CellID:      le.Uint32(b),
+		LAC:         le.Uint16(b[4:]),
+		MCC:         le.Uint16(b[6:]),
+		MNC:         le.Uint16(b[8:]),
+		SignalLevel: b[10],
+	}
+}
+
+func decodeLBS(b []byte) LBS {
+	return LBS{
+		Current:    decodeBaseStation(b),
+		Neighbour1: decodeBaseStation(b[11:]),
+		Neighbour2: decodeBaseStation(b[22:]),
+		Timestamp:  le.Uint32(b[33:]),
+	}
+}
+
+func decodeFuelSensor(b []byte) FuelSensor {
+	return FuelSensor{Level: le.Uint16(b), Temp: int8(b[2])}
+}
+
+func decodeTirePressureSensors(sensors []TirePressureSensor, b []byte) {
+	for i := range sensors {
+		sensors[i] = TirePressureSensor{Wheel: b[i*3], Pressure: b[i*3+1], Temp: int8(b[i*3+2])}
+	}
+}
+
+func decodeAcceleration(b []byte) Acceleration {
+	return Acceleration{X: int16(le.Uint16(b)), Y: int16(le.Uint16(b[2:])), Z: int16(le.Uint16(b[4:]))}
+}
+
+func decodeAccelerationMax(b []byte) AccelerationMax {
+	return AccelerationMax{
+		Positive: int16(le.Uint16(b)),
+		Negative: int16(le.Uint16(b[2:])),
+		Angular:  int16(le.Uint16(b[4:])),
+	}
+}
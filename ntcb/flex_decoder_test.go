@@ -0,0 +1,132 @@
+package ntcb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readTelemetryMessage is the reflection based decoder, which is used as the reference
+func readTelemetryMessage(r io.Reader, ba BitArray) (*RawTelemetryMessage, error) {
+	var te RawTelemetryMessage
+	teValue := reflect.ValueOf(&te).Elem()
+
+	for i := 0; i < FlexFieldCount; i++ {
+		if ba.IsSet(i) {
+			fieldValue := teValue.Field(i)
+			if err := binary.Read(r, binary.LittleEndian, fieldValue.Addr().Interface()); err != nil {
+				return nil, DataExchangeError(err.Error())
+			}
+		}
+	}
+
+	return &te, nil
+}
+
+func TestFlexFieldsSize(t *testing.T) {
+	teValue := reflect.ValueOf(RawTelemetryMessage{})
+	if teValue.NumField() != FlexFieldCount {
+		t.Fatalf("unexpected number of telemetry message fields, %d", teValue.NumField())
+	}
+
+	for i, f := range flexFields {
+		if size := binary.Size(teValue.Field(i).Interface()); int(f.size) != size {
+			t.Errorf("unexpected size of field %s, %d != %d", teValue.Type().Field(i).Name, f.size, size)
+		}
+	}
+}
+
+func TestFlexPlanDecode(t *testing.T) {
+	ba, _ := NewBitArrayFromString(strings.Repeat("1", FlexFieldCount))
+	plan := newFlexPlan(ba)
+
+	record := make([]byte, plan.size)
+	rand.New(rand.NewSource(1)).Read(record)
+
+	expected, err := readTelemetryMessage(bytes.NewReader(record), ba)
+	if err != nil {
+		t.Fatalf("unexpected error decoding with reflection, %v", err)
+	}
+
+	var tm RawTelemetryMessage
+	if err := plan.decode(record, &tm); err != nil {
+		t.Fatalf("unexpected error decoding with plan, %v", err)
+	}
+
+	// compare binary representation, random floats may be NaN
+	var expectedBuff, buff bytes.Buffer
+	_ = binary.Write(&expectedBuff, binary.LittleEndian, expected)
+	_ = binary.Write(&buff, binary.LittleEndian, &tm)
+	if !bytes.Equal(expectedBuff.Bytes(), buff.Bytes()) {
+		t.Errorf("decoded telemetry message differs from reflection based decoder")
+	}
+
+	if err := plan.decode(record[1:], &tm); err == nil {
+		t.Errorf("expected error decoding truncated record")
+	}
+}
+
+func benchmarkTelemetryArray() (BitArray, []byte) {
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	msg, _ := hex.DecodeString(flex10TelemetryArray)
+
+	return ba, msg
+}
+
+func BenchmarkReadTelemetryMessageReflect(b *testing.B) {
+	ba, msg := benchmarkTelemetryArray()
+	record := msg[3 : len(msg)-1]
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := readTelemetryMessage(bytes.NewReader(record), ba); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFlexPlanDecode(b *testing.B) {
+	ba, msg := benchmarkTelemetryArray()
+	record := msg[3 : len(msg)-1]
+	plan := newFlexPlan(ba)
+
+	var tm RawTelemetryMessage
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := plan.decode(record, &tm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type discard struct{}
+
+func (discard) Read([]byte) (int, error)    { return 0, io.EOF }
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+func BenchmarkHandleFlexMessage(b *testing.B) {
+	ba, msg := benchmarkTelemetryArray()
+	c := Conn{conn: faker{ReadWriter: discard{}}, flexBitField: ba}
+
+	r := bytes.NewReader(msg)
+	d := c.dec()
+	d.Reset(r)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(msg)
+		d.Reset(r)
+		f, err := d.Decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := c.handleFrame(f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
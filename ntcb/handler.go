@@ -0,0 +1,121 @@
+package ntcb
+
+// Handler handles the events of the server connections. Handlers are composed into a chain with Middleware:
+// a stage embeds the next Handler, overrides the hooks it needs and calls the next one to continue the chain,
+// so enrichment, filtering or auditing are independent stages. Frames passed to the hooks are valid until
+// the hook returns.
+type Handler interface {
+	// FrameIn is called with every decoded frame before it's handled
+	FrameIn(c *Conn, f *Frame)
+	// FrameOut is called with a copy of every frame written to the device, the hook may keep it or write
+	// to the connection
+	FrameOut(c *Conn, b []byte)
+	// Handshake is called once the handshake is replied
+	Handshake(c *Conn)
+	// Negotiated is called once the FLEX negotiation is replied, the bit field defines the telemetry fields
+	Negotiated(c *Conn, n ProtocolNegotiation)
+	Ping(c *Conn)
+	// DecodeError is called with the error of the data which can't be decoded
+	DecodeError(c *Conn, err error)
+	// AckSent is called once the telemetry frame is acknowledged
+	AckSent(c *Conn, f *Frame)
+
+	// TelemetryMessage and ExtendedTelemetryMessage handle the telemetry with AckOnReceive policy, they're called
+	// by the handler goroutines of the connection. A stage may modify the message or drop it skipping the next one.
+	TelemetryMessage(c *Conn, tm TelemetryMessage)
+	ExtendedTelemetryMessage(c *Conn, tm ExtendedTelemetryMessage)
+	// PersistTelemetryMessages and PersistExtendedTelemetryMessages persist the telemetry with AckOnPersist policy,
+	// the telemetry is not acknowledged if an error is returned. ErrPersistNotSupported passes the telemetry
+	// to TelemetryMessage and ExtendedTelemetryMessage acknowledging it on receive.
+	PersistTelemetryMessages(c *Conn, tms []TelemetryMessage) error
+	PersistExtendedTelemetryMessages(c *Conn, tms []ExtendedTelemetryMessage) error
+}
+
+// hooks returns the handler of the connection, the connections created outside of the server have none
+func (c *Conn) hooks() Handler {
+	if c.handler == nil {
+		return NopHandler{}
+	}
+
+	return c.handler
+}
+
+// frameDecoded passes the result of the frame decoding to the handler, network errors are not decode errors
+func (c *Conn) frameDecoded(f *Frame, err error) {
+	if err == nil {
+		c.hooks().FrameIn(c, f)
+		return
+	}
+
+	if _, ok := err.(FrameError); ok {
+		c.hooks().DecodeError(c, err)
+	}
+}
+
+// Middleware wraps the next handler of the chain
+type Middleware func(next Handler) Handler
+
+// NopHandler ignores the events, it's embedded by the handlers which end the chain. It doesn't persist
+// the telemetry, so the telemetry is passed to TelemetryMessage and ExtendedTelemetryMessage with any ack policy.
+type NopHandler struct{}
+
+func (NopHandler) FrameIn(c *Conn, f *Frame)                                     {}
+func (NopHandler) FrameOut(c *Conn, b []byte)                                    {}
+func (NopHandler) Handshake(c *Conn)                                             {}
+func (NopHandler) Negotiated(c *Conn, n ProtocolNegotiation)                     {}
+func (NopHandler) Ping(c *Conn)                                                  {}
+func (NopHandler) DecodeError(c *Conn, err error)                                {}
+func (NopHandler) AckSent(c *Conn, f *Frame)                                     {}
+func (NopHandler) TelemetryMessage(c *Conn, tm TelemetryMessage)                 {}
+func (NopHandler) ExtendedTelemetryMessage(c *Conn, tm ExtendedTelemetryMessage) {}
+
+func (NopHandler) PersistTelemetryMessages(c *Conn, tms []TelemetryMessage) error {
+	return ErrPersistNotSupported
+}
+
+func (NopHandler) PersistExtendedTelemetryMessages(c *Conn, tms []ExtendedTelemetryMessage) error {
+	return ErrPersistNotSupported
+}
+
+// Chain wraps the handler with the middlewares, the first middleware is the outermost stage
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// callbacksHandler ends the chain of the server calling the callbacks of the options
+type callbacksHandler struct {
+	NopHandler
+	opts *ServerOptions
+}
+
+func (h callbacksHandler) TelemetryMessage(c *Conn, tm TelemetryMessage) {
+	if h.opts.OnTelemetryMessage != nil {
+		h.opts.OnTelemetryMessage(c, tm)
+	}
+}
+
+func (h callbacksHandler) ExtendedTelemetryMessage(c *Conn, tm ExtendedTelemetryMessage) {
+	if h.opts.OnExtendedTelemetryMessage != nil {
+		h.opts.OnExtendedTelemetryMessage(c, tm)
+	}
+}
+
+func (h callbacksHandler) PersistTelemetryMessages(c *Conn, tms []TelemetryMessage) error {
+	if h.opts.PersistTelemetryMessages == nil {
+		return ErrPersistNotSupported
+	}
+
+	return h.opts.PersistTelemetryMessages(c, tms)
+}
+
+func (h callbacksHandler) PersistExtendedTelemetryMessages(c *Conn, tms []ExtendedTelemetryMessage) error {
+	if h.opts.PersistExtendedTelemetryMessages == nil {
+		return ErrPersistNotSupported
+	}
+
+	return h.opts.PersistExtendedTelemetryMessages(c, tms)
+}
@@ -0,0 +1,198 @@
+package ntcb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// auditHandler records the hooks of the chain
+type auditHandler struct {
+	Handler
+	mu     *sync.Mutex
+	events *[]string
+}
+
+func (h auditHandler) record(event string) {
+	h.mu.Lock()
+	*h.events = append(*h.events, event)
+	h.mu.Unlock()
+}
+
+func (h auditHandler) FrameIn(c *Conn, f *Frame) {
+	h.record("in " + frameTypeLabel(f))
+	h.Handler.FrameIn(c, f)
+}
+
+func (h auditHandler) FrameOut(c *Conn, b []byte) {
+	h.record("out")
+	h.Handler.FrameOut(c, b)
+}
+
+func (h auditHandler) Handshake(c *Conn) {
+	h.record("handshake " + c.DeviceID())
+	h.Handler.Handshake(c)
+}
+
+func (h auditHandler) Negotiated(c *Conn, n ProtocolNegotiation) {
+	h.record("negotiated")
+	h.Handler.Negotiated(c, n)
+}
+
+func (h auditHandler) Ping(c *Conn) {
+	h.record("ping")
+	h.Handler.Ping(c)
+}
+
+func (h auditHandler) DecodeError(c *Conn, err error) {
+	h.record("decode error " + errorKindLabel(err))
+	h.Handler.DecodeError(c, err)
+}
+
+func (h auditHandler) AckSent(c *Conn, f *Frame) {
+	h.record("ack " + frameTypeLabel(f))
+	h.Handler.AckSent(c, f)
+}
+
+// dropHandler drops the telemetry of the event and marks the rest
+type dropHandler struct {
+	Handler
+	eventCode uint16
+}
+
+func (h dropHandler) TelemetryMessage(c *Conn, tm TelemetryMessage) {
+	if tm.EventCode == h.eventCode {
+		return
+	}
+
+	tm.Status = 0xff
+	h.Handler.TelemetryMessage(c, tm)
+}
+
+func TestServerMiddlewares(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+		tms    []TelemetryMessage
+	)
+	s := NewServer(ServerOptions{
+		Middlewares: []Middleware{
+			func(next Handler) Handler {
+				return auditHandler{Handler: next, mu: &mu, events: &events}
+			},
+			func(next Handler) Handler {
+				return dropHandler{Handler: next, eventCode: 2}
+			},
+		},
+		OnTelemetryMessage: func(c *Conn, tm TelemetryMessage) {
+			tms = append(tms, tm)
+		},
+	})
+
+	ba, _ := NewBitArrayFromString(strings.Repeat("1", FlexFieldCount))
+	e := NewEncoder(ba)
+
+	kept := RawTelemetryMessage{SeqNo: 1, EventCode: 1}
+	dropped := RawTelemetryMessage{SeqNo: 2, EventCode: 2}
+	corrupted := e.Alarming(3, &kept)
+	corrupted[len(corrupted)-1]++
+
+	serverConn, deviceConn := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, deviceConn)
+	}()
+	s.handleNewConnection(serverConn)
+
+	for _, b := range [][]byte{
+		e.Handshake("100000000000000"),
+		e.ProtocolNegotiation(flexProtocolVersion20, flexProtocolVersion20, FlexFieldCount),
+		e.Alarming(1, &kept),
+		e.Alarming(2, &dropped),
+		corrupted,
+		e.Ping(),
+	} {
+		if _, err := deviceConn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = deviceConn.Close()
+
+	// connection is closed by the device, shutdown waits for the telemetry handlers
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"in handshake", "out", "handshake 100000000000000",
+		"in protocol_negotiation", "out", "negotiated",
+		"in alarming", "out", "ack alarming",
+		"in alarming", "out", "ack alarming",
+		"decode error checksum",
+		"in ping", "ping",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("got events %q, want %q", events, expected)
+	}
+
+	if len(tms) != 1 || tms[0].SeqNo != 1 || tms[0].Status != 0xff {
+		t.Errorf("unexpected telemetry passed the chain %+v", tms)
+	}
+}
+
+// commandHandler sends a command once the telemetry is acknowledged
+type commandHandler struct {
+	NopHandler
+	out []byte
+	err error
+}
+
+func (h *commandHandler) FrameOut(c *Conn, b []byte) {
+	if h.out != nil || b[0] != '~' {
+		return
+	}
+	h.out = b
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, h.err = c.SendCommand(ctx, CommandVersion)
+}
+
+func TestFrameOutWritesToConn(t *testing.T) {
+	var rw = &bytes.Buffer{}
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	h := &commandHandler{}
+	c := Conn{conn: faker{ReadWriter: rw}, id: "100000000000000", flexBitField: ba, handler: h}
+
+	e := NewEncoder(ba)
+	rw.Write(e.Alarming(1, &RawTelemetryMessage{SeqNo: 1}))
+	rw.Write(e.Alarming(2, &RawTelemetryMessage{SeqNo: 2}))
+
+	for i := 0; i < 2; i++ {
+		f, err := c.dec().Decode()
+		if err == nil {
+			err = c.handleFrame(f)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error processing flex telemetry message, %v", err)
+		}
+	}
+
+	// the command is written by the hook, the frame it kept isn't overwritten by the next ack
+	if h.err != ErrCommandTimeout {
+		t.Errorf("expected command timeout, got %v", h.err)
+	}
+	if !bytes.Equal(h.out, []byte{'~', 'T', 1, 0, 0, 0, CRC8([]byte{'~', 'T', 1, 0, 0, 0})}) {
+		t.Errorf("unexpected frame out, %x", h.out)
+	}
+	if !bytes.Contains(rw.Bytes(), CommandVersion) {
+		t.Errorf("command is not written, %x", rw.Bytes())
+	}
+}
@@ -0,0 +1,100 @@
+package ntcb
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// ErrDeviceNotAllowed closes the connection of the device missing from the device list of the listener
+var ErrDeviceNotAllowed = ProtocolError("device is not allowed on the listener")
+
+// ListenerProfile configures a listener and the connections accepted by it, so fleets or test firmware
+// can be served on separate ports by a single server
+type ListenerProfile struct {
+	// Name is reported by Conn.Listener
+	Name    string
+	Address string
+	Debug   bool
+	// TLSConfig enables TLS on the connections, see ServerOptions.TLSConfig
+	TLSConfig *tls.Config
+	// FlexVersions are the FLEX versions the devices may negotiate e.g. 10 and 20, empty allows all
+	FlexVersions []uint8
+	AckPolicy    AckPolicy
+	// Devices are the IDs of the devices allowed to connect, empty allows all
+	Devices []string
+	// Tags are reported by Conn.Tags to label the data of the devices
+	Tags map[string]string
+}
+
+// listener is the profile prepared to serve connections
+type listener struct {
+	ListenerProfile
+	devices map[string]struct{}
+}
+
+func newListener(p ListenerProfile) *listener {
+	l := &listener{ListenerProfile: p}
+	if len(p.Devices) > 0 {
+		l.devices = make(map[string]struct{}, len(p.Devices))
+		for _, id := range p.Devices {
+			l.devices[id] = struct{}{}
+		}
+	}
+
+	return l
+}
+
+// allowsDevice reports whether the device may connect to the listener
+func (l *listener) allowsDevice(id string) bool {
+	if l == nil || l.devices == nil {
+		return true
+	}
+
+	_, ok := l.devices[id]
+	return ok
+}
+
+// allowsFlexVersion reports whether the FLEX version may be negotiated on the listener
+func (l *listener) allowsFlexVersion(v uint8) bool {
+	if l == nil || len(l.FlexVersions) == 0 {
+		return true
+	}
+
+	for _, allowed := range l.FlexVersions {
+		if allowed == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseFlexVersion parses the FLEX version: 1.0 or 2.0
+func ParseFlexVersion(s string) (uint8, error) {
+	switch s {
+	case "1.0", "10":
+		return flexProtocolVersion10, nil
+	case "2.0", "20":
+		return flexProtocolVersion20, nil
+	}
+
+	return 0, fmt.Errorf("unknown FLEX version %q", s)
+}
+
+// Listener returns the name of the listener the connection is accepted by
+func (c *Conn) Listener() string {
+	if c.listener == nil {
+		return ""
+	}
+
+	return c.listener.Name
+}
+
+// Tags returns the tags of the listener the connection is accepted by, the map must not be modified
+func (c *Conn) Tags() map[string]string {
+	if c.listener == nil {
+		return nil
+	}
+
+	return c.listener.Tags
+}
@@ -0,0 +1,171 @@
+package ntcb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerFlexVersions(t *testing.T) {
+	ba, _ := NewBitArrayFromString(strings.Repeat("1", 122))
+
+	for _, tc := range []struct {
+		allowed                  []uint8
+		version, expectedVersion uint8
+		expectedErr              bool
+	}{
+		{allowed: []uint8{flexProtocolVersion10}, version: flexProtocolVersion20, expectedVersion: flexProtocolVersion10},
+		{allowed: []uint8{flexProtocolVersion20}, version: flexProtocolVersion20, expectedVersion: flexProtocolVersion20},
+		{allowed: []uint8{flexProtocolVersion20}, version: flexProtocolVersion10, expectedErr: true},
+	} {
+		var rw = &bytes.Buffer{}
+		handled := make(chan TelemetryMessage, 1)
+		c := Conn{
+			conn:     faker{ReadWriter: rw},
+			listener: newListener(ListenerProfile{FlexVersions: tc.allowed}),
+			pool:     telemetryPool(t, handled),
+		}
+
+		msg := append([]byte("*>FLEX"), 0xb0, tc.version, tc.version, 122)
+		msg = append(msg, ba...)
+		writeDeviceReply(rw, Header{Pre: [4]byte{'@', 'N', 'T', 'C'}}, msg)
+
+		f, err := c.dec().Decode()
+		if err != nil {
+			t.Fatalf("unexpected error decoding protocol negotiation, %v", err)
+		}
+
+		err = c.handleFrame(f)
+		if tc.expectedErr {
+			if fe, ok := err.(FrameError); !ok || fe.Kind != FrameErrorUnsupportedVersion || !fe.Fatal {
+				t.Errorf("unexpected error of the disallowed version %d, %v", tc.version, err)
+			}
+			if rw.Len() != 0 {
+				t.Errorf("unexpected reply to the disallowed version, %x", rw.Bytes())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error during protocol negotiation, %v", err)
+		}
+
+		reply := rw.Bytes()[16:]
+		if !bytes.Equal(reply, append([]byte("*<FLEX"), 0xb0, tc.expectedVersion, tc.expectedVersion)) {
+			t.Errorf("unexpected protocol negotiation reply, %x", reply)
+		}
+		rw.Reset()
+
+		// the device sends the records of the negotiated struct version
+		fields := ba
+		if tc.expectedVersion == flexProtocolVersion10 {
+			fields = ba.truncate(FlexFieldCount10)
+		}
+		rw.Write(NewEncoder(fields).Alarming(7, &RawTelemetryMessage{SeqNo: 7, CANSpeed: 0x36}))
+
+		if f, err = c.dec().Decode(); err == nil {
+			err = c.handleFrame(f)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error handling telemetry of FLEX %d, %v", tc.expectedVersion, err)
+		}
+
+		if !bytes.Equal(rw.Bytes(), []byte{'~', 'T', 7, 0, 0, 0, CRC8([]byte{'~', 'T', 7, 0, 0, 0})}) {
+			t.Errorf("unexpected telemetry reply, %x", rw.Bytes())
+		}
+		if tm := <-handled; tm.SeqNo != 7 || tm.CANSpeed != 0x36 {
+			t.Errorf("unexpected telemetry message, %#v", tm)
+		}
+	}
+}
+
+func TestServerListeners(t *testing.T) {
+	connected := make(chan *Conn, 2)
+	closed := make(chan error, 2)
+	s := NewServer(ServerOptions{
+		OnNewConnection: func(c *Conn) {
+			connected <- c
+		},
+		OnConnectionClosed: func(c *Conn, err error) {
+			// devices closing the connections are not reported
+			if err != nil {
+				closed <- err
+			}
+		},
+	})
+	defer s.Stop()
+
+	profiles := []ListenerProfile{
+		{Name: "fleet", Devices: []string{"100000000000000"}, Tags: map[string]string{"customer": "fleet"}},
+		{Name: "test"},
+	}
+	addrs := make([]string, len(profiles))
+	for i, p := range profiles {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		go func(p ListenerProfile) {
+			_ = s.ServeListener(context.Background(), l, p)
+		}(p)
+	}
+
+	tests := []struct {
+		name     string
+		addr     string
+		deviceID string
+		listener string
+		tags     map[string]string
+		err      error
+	}{
+		{name: "allowed device", addr: addrs[0], deviceID: "100000000000000", listener: "fleet", tags: profiles[0].Tags},
+		{name: "device not allowed", addr: addrs[0], deviceID: "200000000000000", err: ErrDeviceNotAllowed},
+		{name: "listener allowing all devices", addr: addrs[1], deviceID: "200000000000000", listener: "test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(NewEncoder(nil).Handshake(tt.deviceID)); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, ntcbHeaderSize+3)
+			_, err = io.ReadFull(conn, reply)
+
+			if tt.err != nil {
+				if err == nil {
+					t.Errorf("unexpected handshake reply %x", reply)
+				}
+				select {
+				case err := <-closed:
+					if err != tt.err {
+						t.Errorf("got error %v, want %v", err, tt.err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("connection is not closed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := <-connected
+			if c.DeviceID() != tt.deviceID || c.Listener() != tt.listener {
+				t.Errorf("got device %s on listener %q, want %s on %q", c.DeviceID(), c.Listener(), tt.deviceID, tt.listener)
+			}
+			if c.Tags()["customer"] != tt.tags["customer"] {
+				t.Errorf("unexpected tags %v", c.Tags())
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package ntcb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrReadTimeout closes the connection of the device which sent nothing within the read timeout
+	ErrReadTimeout = TimeoutError("no data received within read timeout")
+	// ErrPingTimeout closes the connection of the device which stopped pinging
+	ErrPingTimeout = TimeoutError("no ping received within ping timeout")
+)
+
+// TimeoutError is returned when the device is considered lost and its connection is closed
+type TimeoutError string
+
+func (e TimeoutError) Error() string {
+	return string(e)
+}
+
+func (e TimeoutError) Timeout() bool {
+	return true
+}
+
+// livenessOptions configures the liveness checks of the connection, zero timeouts disable the checks
+type livenessOptions struct {
+	idleTimeout time.Duration
+	readTimeout time.Duration
+	pingTimeout time.Duration
+
+	onIdle    func(c *Conn, idle time.Duration)
+	onTimeout func(c *Conn, err error)
+}
+
+// interval returns the check interval, which is a quarter of the shortest timeout
+func (o livenessOptions) interval() time.Duration {
+	var interval time.Duration
+	for _, t := range []time.Duration{o.idleTimeout, o.readTimeout, o.pingTimeout} {
+		if t > 0 && (interval == 0 || t < interval) {
+			interval = t
+		}
+	}
+
+	return interval / 4
+}
+
+// LastReadAt returns the time of the last data received from the device
+func (c *Conn) LastReadAt() time.Time {
+	return unixNano(atomic.LoadInt64(&c.lastReadAt))
+}
+
+// LastPingAt returns the time of the last ping received from the device, it's zero if the device doesn't ping
+func (c *Conn) LastPingAt() time.Time {
+	return unixNano(atomic.LoadInt64(&c.lastPingAt))
+}
+
+// suspendLiveness suspends the liveness checks while the read loop persists the telemetry, the device isn't
+// read meanwhile, so a slow persist handler must not time it out
+func (c *Conn) suspendLiveness() {
+	atomic.StoreInt32(&c.persisting, 1)
+}
+
+// resumeLiveness resumes the liveness checks, the read and ping timeouts are counted from now on
+func (c *Conn) resumeLiveness() {
+	atomic.StoreInt64(&c.persistedAt, time.Now().UnixNano())
+	atomic.StoreInt32(&c.persisting, 0)
+}
+
+// sinceActive returns the time passed since t or the end of the last persist, whichever is later
+func (c *Conn) sinceActive(now, t time.Time) time.Duration {
+	if persistedAt := unixNano(atomic.LoadInt64(&c.persistedAt)); persistedAt.After(t) {
+		t = persistedAt
+	}
+
+	return now.Sub(t)
+}
+
+func unixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ns)
+}
+
+// watchLiveness checks the connection until it's closed. The idle device is reported once per idle period,
+// the device which sent nothing within the read timeout or stopped pinging is timed out and its connection
+// is closed, so the read loop fails with the timeout error. The checks are suspended while the read loop persists
+// the telemetry.
+func (c *Conn) watchLiveness(o livenessOptions) {
+	interval := o.interval()
+	if interval <= 0 {
+		return
+	}
+
+	atomic.CompareAndSwapInt64(&c.lastReadAt, 0, time.Now().UnixNano())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		idle := false
+		for {
+			select {
+			case <-c.done:
+				return
+			case now := <-ticker.C:
+				if atomic.LoadInt32(&c.persisting) != 0 {
+					continue
+				}
+				sinceRead := c.sinceActive(now, c.LastReadAt())
+
+				var err error
+				switch lastPingAt := c.LastPingAt(); {
+				case o.readTimeout > 0 && sinceRead > o.readTimeout:
+					err = ErrReadTimeout
+				// pings are expected once the device has sent one
+				case o.pingTimeout > 0 && !lastPingAt.IsZero() && c.sinceActive(now, lastPingAt) > o.pingTimeout:
+					err = ErrPingTimeout
+				}
+
+				if err != nil {
+					if o.onTimeout != nil {
+						o.onTimeout(c, err)
+					}
+					c.closeWith(err)
+					return
+				}
+
+				if o.idleTimeout > 0 {
+					wasIdle := idle
+					idle = sinceRead > o.idleTimeout
+					if idle && !wasIdle && o.onIdle != nil {
+						o.onIdle(c, sinceRead)
+					}
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,167 @@
+package ntcb
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectDevice connects the device to the server over a pipe and performs the handshake
+func connectDevice(t *testing.T, s *Server) net.Conn {
+	serverConn, deviceConn := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, deviceConn)
+	}()
+
+	s.handleNewConnection(serverConn)
+	if _, err := deviceConn.Write(NewEncoder(nil).Handshake("100000000000000")); err != nil {
+		t.Fatal(err)
+	}
+
+	return deviceConn
+}
+
+func TestServerLiveness(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        ServerOptions
+		ping        bool
+		expectedErr error
+	}{
+		{name: "read timeout", opts: ServerOptions{ReadTimeout: 50 * time.Millisecond}, expectedErr: ErrReadTimeout},
+		{name: "ping timeout", opts: ServerOptions{PingTimeout: 50 * time.Millisecond}, ping: true, expectedErr: ErrPingTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeoutErr := make(chan error, 1)
+			closedErr := make(chan error, 1)
+			opts := tt.opts
+			opts.OnDeviceTimeout = func(c *Conn, err error) {
+				timeoutErr <- err
+			}
+			opts.OnConnectionClosed = func(c *Conn, err error) {
+				closedErr <- err
+			}
+			s := NewServer(opts)
+
+			deviceConn := connectDevice(t, s)
+			defer deviceConn.Close()
+
+			if tt.ping {
+				// pings are expected once the device has sent one
+				time.Sleep(100 * time.Millisecond)
+				if _, ok := s.Conn("100000000000000"); !ok {
+					t.Fatalf("device which doesn't ping is timed out")
+				}
+				if _, err := deviceConn.Write(NewEncoder(nil).Ping()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case err := <-timeoutErr:
+				if err != tt.expectedErr {
+					t.Errorf("unexpected timeout error %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("device is not timed out")
+			}
+
+			if err := <-closedErr; err != tt.expectedErr {
+				t.Errorf("unexpected connection error %v", err)
+			}
+			if _, ok := s.Conn("100000000000000"); ok {
+				t.Errorf("timed out device is left in the registry")
+			}
+		})
+	}
+}
+
+func TestServerDeviceIdle(t *testing.T) {
+	idle := make(chan time.Duration, 2)
+	s := NewServer(ServerOptions{
+		IdleTimeout: 50 * time.Millisecond,
+		OnDeviceIdle: func(c *Conn, d time.Duration) {
+			idle <- d
+		},
+	})
+
+	deviceConn := connectDevice(t, s)
+	defer deviceConn.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-idle:
+			if d < 50*time.Millisecond {
+				t.Errorf("unexpected idle duration %v", d)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("device is not reported idle")
+		}
+
+		// idle device is reported once per idle period
+		select {
+		case <-idle:
+			t.Fatal("idle device is reported twice")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if _, err := deviceConn.Write(NewEncoder(nil).Ping()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := s.Conn("100000000000000"); !ok {
+		t.Errorf("idle device is removed from the registry")
+	}
+}
+
+func TestServerLivenessWhilePersisting(t *testing.T) {
+	timeoutErr := make(chan error, 1)
+	persisted := make(chan time.Time, 1)
+	s := NewServer(ServerOptions{
+		ReadTimeout: 50 * time.Millisecond,
+		AckPolicy:   AckOnPersist,
+		PersistTelemetryMessages: func(c *Conn, tms []TelemetryMessage) error {
+			// the slow storage takes a few read timeouts
+			time.Sleep(200 * time.Millisecond)
+			persisted <- time.Now()
+			return nil
+		},
+		OnDeviceTimeout: func(c *Conn, err error) {
+			timeoutErr <- err
+		},
+	})
+
+	deviceConn := connectDevice(t, s)
+	defer deviceConn.Close()
+
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	e := NewEncoder(ba)
+	for _, b := range [][]byte{e.ProtocolNegotiation(10, 10, 72), e.Alarming(1, &RawTelemetryMessage{SeqNo: 1})} {
+		if _, err := deviceConn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var persistedAt time.Time
+	select {
+	case persistedAt = <-persisted:
+	case err := <-timeoutErr:
+		t.Fatalf("device is timed out while its telemetry is persisted, %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("telemetry is not persisted")
+	}
+
+	// the read timeout is counted from the end of the persist
+	select {
+	case err := <-timeoutErr:
+		if err != ErrReadTimeout || time.Since(persistedAt) < 50*time.Millisecond {
+			t.Errorf("unexpected timeout %v after %v", err, time.Since(persistedAt))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("device is not timed out after the persist")
+	}
+}
@@ -0,0 +1,128 @@
+package ntcb
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the level of the log entry
+type LogLevel int
+
+const (
+	// LevelDebug entries trace the data exchange of the connections with debug enabled
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Field is the key-value pair of the log entry e.g. the device ID or the frame bytes
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger writes the log entries of the package, it's called concurrently by the connections.
+// Debug entries are written only for the connections with debug enabled, so the logger shouldn't filter them out.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+// stdLogger writes the entries with the standard logger, it's used if no logger is set
+type stdLogger struct{}
+
+func (stdLogger) Log(level LogLevel, msg string, fields ...Field) {
+	var b strings.Builder
+	b.WriteString("ntcb: ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case []byte:
+			fmt.Fprintf(&b, ", %s=%x", f.Key, v)
+		default:
+			fmt.Fprintf(&b, ", %s=%v", f.Key, v)
+		}
+	}
+	if level != LevelDebug && level != LevelInfo {
+		fmt.Fprintf(&b, ", level=%s", level)
+	}
+
+	log.Println(b.String())
+}
+
+// log writes the entry with the device ID and the remote address of the connection
+func (c *Conn) log(level LogLevel, msg string, fields ...Field) {
+	logger := c.logger
+	if logger == nil {
+		logger = stdLogger{}
+	}
+
+	logger.Log(level, msg, append([]Field{{"remoteAddr", c.RemoteAddr()}, {"deviceID", c.id}}, fields...)...)
+}
+
+// SetDebug enables or disables the debug entries of the connection at runtime
+func (c *Conn) SetDebug(debug bool) {
+	var v int32
+	if debug {
+		v = 1
+	}
+	atomic.StoreInt32(&c.debug, v)
+}
+
+// Debug reports whether the debug entries of the connection are written
+func (c *Conn) Debug() bool {
+	return atomic.LoadInt32(&c.debug) == 1
+}
+
+// SetDeviceDebug enables or disables the debug entries of the device connections, the setting is kept
+// for the connections the device makes later
+func (s *Server) SetDeviceDebug(id string, debug bool) {
+	s.connMu.Lock()
+	s.debugDevices[id] = debug
+	conns := append([]*Conn(nil), s.conns[id]...)
+	s.connMu.Unlock()
+
+	for _, c := range conns {
+		c.SetDebug(debug)
+	}
+}
+
+// ResetDeviceDebug forgets the debug setting of the device, its connections are debugged with the listener setting
+func (s *Server) ResetDeviceDebug(id string) {
+	s.connMu.Lock()
+	delete(s.debugDevices, id)
+	conns := append([]*Conn(nil), s.conns[id]...)
+	s.connMu.Unlock()
+
+	for _, c := range conns {
+		c.SetDebug(c.listener != nil && c.listener.Debug)
+	}
+}
+
+// applyDeviceDebug applies the debug setting of the device to its connection on the handshake
+func (s *Server) applyDeviceDebug(c *Conn) {
+	s.connMu.Lock()
+	debug, ok := s.debugDevices[c.id]
+	s.connMu.Unlock()
+
+	if ok {
+		c.SetDebug(debug)
+	}
+}
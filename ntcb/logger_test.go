@@ -0,0 +1,99 @@
+package ntcb
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger keeps the entries in memory
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, fields ...Field) {
+	e := logEntry{level: level, msg: msg, fields: make(map[string]interface{}, len(fields))}
+	for _, f := range fields {
+		e.fields[f.Key] = f.Value
+	}
+
+	l.mu.Lock()
+	l.entries = append(l.entries, e)
+	l.mu.Unlock()
+}
+
+// pings returns the number of the ping entries
+func (l *recordingLogger) pings(t *testing.T) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, e := range l.entries {
+		if e.msg == "ping" {
+			if e.level != LevelDebug || e.fields["deviceID"] != "100000000000000" {
+				t.Errorf("unexpected ping entry %+v", e)
+			}
+			n++
+		}
+	}
+
+	return n
+}
+
+// ping sends the ping and waits until it's handled
+func ping(t *testing.T, c *Conn, deviceConn net.Conn) {
+	last := c.LastPingAt()
+	if _, err := deviceConn.Write(NewEncoder(nil).Ping()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.LastPingAt().Equal(last) {
+		if time.Now().After(deadline) {
+			t.Fatal("ping is not handled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerDeviceDebug(t *testing.T) {
+	logger := &recordingLogger{}
+	s := NewServer(ServerOptions{Logger: logger, DebugDevices: []string{"100000000000000"}})
+	defer s.Stop()
+
+	deviceConn, c := connectDeviceFrom(t, s, "10.0.0.1:1000")
+	defer deviceConn.Close()
+
+	if !c.Debug() {
+		t.Fatal("debug of the listed device is disabled")
+	}
+	ping(t, c, deviceConn)
+	if n := logger.pings(t); n != 1 {
+		t.Fatalf("got %d ping entries, want 1", n)
+	}
+
+	s.SetDeviceDebug("100000000000000", false)
+	ping(t, c, deviceConn)
+	if n := logger.pings(t); n != 1 {
+		t.Fatalf("got %d ping entries with debug disabled, want 1", n)
+	}
+
+	s.SetDeviceDebug("100000000000000", true)
+	ping(t, c, deviceConn)
+	if n := logger.pings(t); n != 2 {
+		t.Fatalf("got %d ping entries with debug enabled at runtime, want 2", n)
+	}
+
+	s.ResetDeviceDebug("100000000000000")
+	if c.Debug() {
+		t.Error("debug is enabled after the reset to the listener setting")
+	}
+}
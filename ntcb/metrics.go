@@ -0,0 +1,70 @@
+package ntcb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics observes the connections of the server e.g. to export Prometheus metrics. It's called concurrently
+// by the connections on the data path, so it must not block. Frame types are the FrameType names, FLEX telemetry
+// frames are named by MessageType: alarming (~T), current (~C), array (~A), extended_alarming (~X)
+// and extended_array (~E).
+type Metrics interface {
+	// ConnectionAccepted is called for every accepted connection including the rejected ones
+	ConnectionAccepted(listener string)
+	ConnectionClosed(listener string, err error)
+	// Handshake is called once the handshake is passed or failed with the error
+	Handshake(err error)
+	FrameReceived(frameType string, bytes int)
+	// FrameError is called with the kind of the frame error: framing, checksum, unsupported_version, truncated
+	// or data_exchange
+	FrameError(kind string)
+	// TelemetryAcknowledged is called with the duration since the telemetry frame is read till it's acknowledged
+	TelemetryAcknowledged(frameType string, latency time.Duration)
+}
+
+// frameTypeLabel returns the name of the frame type reported to Metrics
+func frameTypeLabel(f *Frame) string {
+	if f.MessageType != "" && (f.Type == FrameTypeTelemetry || f.Type == FrameTypeExtendedTelemetry) {
+		return string(f.MessageType)
+	}
+
+	return f.Type.String()
+}
+
+// errorKindLabel returns the kind of the error reported to Metrics, empty for the errors which are not frame errors
+func errorKindLabel(err error) string {
+	switch e := err.(type) {
+	case FrameError:
+		if e.Kind.known() {
+			return e.Kind.String()
+		}
+	case DataExchangeError:
+		return "data_exchange"
+	}
+
+	return ""
+}
+
+// QueuedMessages returns the number of the telemetry messages waiting for the handlers including the spilled ones
+func (s *Server) QueuedMessages() int {
+	return s.pool.queued()
+}
+
+// SpilledMessages returns the number of the telemetry messages waiting for the handlers in the spill files
+func (s *Server) SpilledMessages() int {
+	return s.pool.spilled()
+}
+
+// DroppedMessages returns the number of the telemetry messages dropped by the backpressure policy
+func (s *Server) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&s.pool.dropped)
+}
+
+// ActiveConns returns the number of the connections being served including the ones before the handshake
+func (s *Server) ActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.active)
+}
@@ -0,0 +1,111 @@
+package ntcb
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics counts the observations by name
+type recordingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *recordingMetrics) add(name string) {
+	m.mu.Lock()
+	m.counts[name]++
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) ConnectionAccepted(listener string) {
+	m.add("accepted")
+}
+
+func (m *recordingMetrics) ConnectionClosed(listener string, err error) {
+	m.add("closed")
+}
+
+func (m *recordingMetrics) Handshake(err error) {
+	if err == nil {
+		m.add("handshake")
+	}
+}
+
+func (m *recordingMetrics) FrameReceived(frameType string, bytes int) {
+	m.add("frame " + frameType)
+}
+
+func (m *recordingMetrics) FrameError(kind string) {
+	m.add("error " + kind)
+}
+
+func (m *recordingMetrics) TelemetryAcknowledged(frameType string, latency time.Duration) {
+	m.add("ack " + frameType)
+}
+
+func TestServerMetrics(t *testing.T) {
+	metrics := &recordingMetrics{counts: make(map[string]int)}
+	closed := make(chan struct{})
+	s := NewServer(ServerOptions{
+		Metrics:            metrics,
+		OnTelemetryMessage: func(c *Conn, tm TelemetryMessage) {},
+		OnConnectionClosed: func(c *Conn, err error) {
+			close(closed)
+		},
+	})
+	defer s.Stop()
+
+	ba, _ := NewBitArrayFromString(strings.Repeat("1", FlexFieldCount))
+	e := NewEncoder(ba)
+	var tm RawTelemetryMessage
+
+	corrupted := e.Alarming(2, &tm)
+	corrupted[len(corrupted)-1]++
+
+	serverConn, deviceConn := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, deviceConn)
+	}()
+	s.handleNewConnection(serverConn)
+
+	for _, b := range [][]byte{
+		e.Handshake("100000000000000"),
+		e.ProtocolNegotiation(flexProtocolVersion20, flexProtocolVersion20, FlexFieldCount),
+		e.Alarming(1, &tm),
+		corrupted,
+		e.Ping(),
+	} {
+		if _, err := deviceConn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = deviceConn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+
+	expected := map[string]int{
+		"accepted":                   1,
+		"handshake":                  1,
+		"frame handshake":            1,
+		"frame protocol_negotiation": 1,
+		"frame alarming":             1,
+		"frame ping":                 1,
+		"error checksum":             1,
+		"ack alarming":               1,
+		"closed":                     1,
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if !reflect.DeepEqual(metrics.counts, expected) {
+		t.Errorf("got metrics %v, want %v", metrics.counts, expected)
+	}
+}
@@ -0,0 +1,487 @@
+package ntcb
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultWorkers    = 32
+	defaultQueueSize  = 128
+	defaultSpillLimit = 65536
+)
+
+// BackpressurePolicy defines what happens to the telemetry of a device when the queue of its worker is full
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock blocks the read loop of the device until the worker takes a message from the queue,
+	// the device isn't acknowledged meanwhile
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDropOldest drops the oldest queued message of the device to make room for the new one,
+	// the messages of the other devices sharing the worker are never dropped, so the device which has no message
+	// in the queue is blocked
+	BackpressureDropOldest
+	// BackpressureSpill writes the messages exceeding the queue to the spill file of the worker, the file is read
+	// once the queue is drained and removed once it's read. The device is blocked once the spill limit is reached
+	// or the file can't be written. The spilled messages are lost if the server crashes.
+	BackpressureSpill
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case BackpressureBlock:
+		return "block"
+	case BackpressureDropOldest:
+		return "drop-oldest"
+	case BackpressureSpill:
+		return "spill"
+	}
+
+	return fmt.Sprintf("BackpressurePolicy(%d)", int(p))
+}
+
+// ParseBackpressurePolicy parses the policy name: block, drop-oldest or spill
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch s {
+	case "", "block":
+		return BackpressureBlock, nil
+	case "drop-oldest":
+		return BackpressureDropOldest, nil
+	case "spill":
+		return BackpressureSpill, nil
+	}
+
+	return BackpressureBlock, fmt.Errorf("unknown backpressure policy %q", s)
+}
+
+// job is the telemetry message of the connection queued for the handlers, etm is set for the extended telemetry
+type job struct {
+	c        *Conn
+	extended bool
+	tm       TelemetryMessage
+	etm      ExtendedTelemetryMessage
+}
+
+// workerPool passes the queued telemetry to the handlers. The messages of a device are queued to the same worker,
+// so they're handled in order, while the number of the goroutines doesn't depend on the number of the devices.
+type workerPool struct {
+	policy     BackpressurePolicy
+	spillDir   string
+	spillLimit int
+	handle     func(j *job)
+	logger     Logger
+	workers    []*worker
+	wg         sync.WaitGroup
+	dropped    uint64
+}
+
+// worker is the bounded queue of the pool and the goroutine draining it. The mutex guards the queue state only,
+// the spill file is written and read without it.
+type worker struct {
+	mu       sync.Mutex
+	notEmpty sync.Cond
+	notFull  sync.Cond
+	// ring buffer of the queued jobs
+	jobs       []job
+	head, size int
+	// spill keeps the jobs queued after the ones of the ring buffer, it's nil if nothing is spilled. spilled counts
+	// its messages including the ones being written, readable counts the written ones not read yet.
+	spill    *spillFile
+	spilled  int
+	readable int
+	closed   bool
+}
+
+func newWorkerPool(opts *ServerOptions, handle func(j *job)) *workerPool {
+	workers, queueSize, spillLimit := opts.Workers, opts.QueueSize, opts.SpillLimit
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	if spillLimit <= 0 {
+		spillLimit = defaultSpillLimit
+	}
+
+	p := &workerPool{
+		policy:     opts.Backpressure,
+		spillDir:   opts.SpillDir,
+		spillLimit: spillLimit,
+		handle:     handle,
+		logger:     opts.Logger,
+		workers:    make([]*worker, workers),
+	}
+	if p.logger == nil {
+		p.logger = stdLogger{}
+	}
+
+	p.wg.Add(workers)
+	for i := range p.workers {
+		w := &worker{jobs: make([]job, queueSize)}
+		w.notEmpty.L = &w.mu
+		w.notFull.L = &w.mu
+		p.workers[i] = w
+
+		go p.run(w)
+	}
+
+	return p
+}
+
+// worker returns the worker of the device, FNV-1a hash of the device ID picks it
+func (p *workerPool) worker(deviceID string) *worker {
+	h := uint32(2166136261)
+	for i := 0; i < len(deviceID); i++ {
+		h ^= uint32(deviceID[i])
+		h *= 16777619
+	}
+
+	return p.workers[h%uint32(len(p.workers))]
+}
+
+func (p *workerPool) pushTelemetryMessage(c *Conn, tm *TelemetryMessage) {
+	w := p.worker(c.id)
+
+	for {
+		w.mu.Lock()
+		j, s := p.reserve(w, c)
+		if j != nil {
+			j.c, j.extended, j.tm = c, false, *tm
+			w.notEmpty.Signal()
+		}
+		w.mu.Unlock()
+
+		if s == nil || p.spill(w, s, c, &spillRecord{TelemetryMessage: tm}) {
+			return
+		}
+	}
+}
+
+func (p *workerPool) pushExtendedTelemetryMessage(c *Conn, tm *ExtendedTelemetryMessage) {
+	w := p.worker(c.id)
+
+	for {
+		w.mu.Lock()
+		j, s := p.reserve(w, c)
+		if j != nil {
+			j.c, j.extended, j.etm = c, true, *tm
+			w.notEmpty.Signal()
+		}
+		w.mu.Unlock()
+
+		if s == nil || p.spill(w, s, c, &spillRecord{ExtendedTelemetryMessage: tm}) {
+			return
+		}
+	}
+}
+
+// reserve returns the slot of the ring buffer for the new job applying the backpressure policy, or the spill file
+// the job must be written to, nothing is returned if the job is dropped. It's called with w.mu held.
+func (p *workerPool) reserve(w *worker, c *Conn) (*job, *spillFile) {
+	for {
+		if w.closed {
+			// the pool is closed on shutdown after the connections, so only the ones left behind get here
+			atomic.AddUint64(&p.dropped, 1)
+			c.log(LevelWarn, "telemetry message is dropped, server is closed")
+			return nil, nil
+		}
+
+		if w.spill == nil && w.size < len(w.jobs) {
+			j := &w.jobs[(w.head+w.size)%len(w.jobs)]
+			w.size++
+			return j, nil
+		}
+
+		switch {
+		case p.policy == BackpressureDropOldest && w.dropOldest(c.id):
+			atomic.AddUint64(&p.dropped, 1)
+		case p.policy == BackpressureSpill && w.spilled < p.spillLimit && (w.spill == nil || !w.spill.failed):
+			if w.spill == nil {
+				w.spill = &spillFile{}
+			}
+			w.spilled++
+			return nil, w.spill
+		default:
+			w.notFull.Wait()
+		}
+	}
+}
+
+// dropOldest drops the oldest queued job of the device, false is returned if the device has none.
+// It's called with w.mu held.
+func (w *worker) dropOldest(deviceID string) bool {
+	n := len(w.jobs)
+	for i := 0; i < w.size; i++ {
+		if w.jobs[(w.head+i)%n].c.id != deviceID {
+			continue
+		}
+
+		for k := i; k < w.size-1; k++ {
+			w.jobs[(w.head+k)%n] = w.jobs[(w.head+k+1)%n]
+		}
+		w.jobs[(w.head+w.size-1)%n] = job{}
+		w.size--
+
+		return true
+	}
+
+	return false
+}
+
+// spill writes the message to the spill file reserved for it, false is returned if it isn't written and must be
+// pushed again, the pushers block then until the file is drained
+func (p *workerPool) spill(w *worker, s *spillFile, c *Conn, r *spillRecord) bool {
+	err := s.write(p.spillDir, c, r)
+
+	w.mu.Lock()
+	if err == nil {
+		w.readable++
+		w.notEmpty.Signal()
+		w.mu.Unlock()
+		return true
+	}
+
+	s.failed = true
+	w.spilled--
+	drained := w.spilled == 0
+	if drained {
+		w.spill = nil
+		w.notFull.Broadcast()
+		// the closed worker waiting for the message may stop
+		w.notEmpty.Broadcast()
+	}
+	w.mu.Unlock()
+
+	c.log(LevelError, "unable to spill telemetry message, the device is blocked until the queue is drained",
+		Field{"err", err})
+	if drained {
+		s.remove()
+	}
+
+	return false
+}
+
+func (p *workerPool) run(w *worker) {
+	defer p.wg.Done()
+
+	var j job
+	for p.next(w, &j) {
+		p.handle(&j)
+		// the message is copied to the handlers, the connection isn't referenced until the next job
+		j = job{}
+	}
+}
+
+// next takes the oldest job of the worker, false is returned once the worker is closed and drained
+func (p *workerPool) next(w *worker, j *job) bool {
+	w.mu.Lock()
+
+	for {
+		if w.size > 0 {
+			*j = w.jobs[w.head]
+			w.jobs[w.head] = job{}
+			w.head = (w.head + 1) % len(w.jobs)
+			w.size--
+			w.notFull.Signal()
+			w.mu.Unlock()
+			return true
+		}
+
+		if w.readable > 0 {
+			s := w.spill
+			w.readable--
+			w.mu.Unlock()
+
+			err := s.read(j)
+
+			w.mu.Lock()
+			w.spilled--
+			drained := w.spilled == 0
+			if drained {
+				w.spill = nil
+				w.notFull.Broadcast()
+			} else {
+				// the pusher blocked by the spill limit may continue
+				w.notFull.Signal()
+			}
+			w.mu.Unlock()
+
+			if drained {
+				s.remove()
+			}
+			if err == nil {
+				return true
+			}
+
+			atomic.AddUint64(&p.dropped, 1)
+			if err != errSpillCorrupted {
+				p.logger.Log(LevelError, "spilled telemetry messages are dropped, unable to read them", Field{"err", err})
+			}
+
+			w.mu.Lock()
+			continue
+		}
+
+		// the messages being spilled are awaited on close
+		if w.closed && w.spill == nil {
+			w.mu.Unlock()
+			return false
+		}
+		w.notEmpty.Wait()
+	}
+}
+
+// close stops the workers once they handle the queued messages
+func (p *workerPool) close() {
+	for _, w := range p.workers {
+		w.mu.Lock()
+		w.closed = true
+		w.notEmpty.Broadcast()
+		w.notFull.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// wait returns the channel closed once the workers are stopped
+func (p *workerPool) wait() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// queued returns the number of the queued messages including the spilled ones
+func (p *workerPool) queued() int {
+	n := 0
+	for _, w := range p.workers {
+		w.mu.Lock()
+		n += w.size + w.spilled
+		w.mu.Unlock()
+	}
+
+	return n
+}
+
+// spilled returns the number of the messages in the spill files
+func (p *workerPool) spilled() int {
+	n := 0
+	for _, w := range p.workers {
+		w.mu.Lock()
+		n += w.spilled
+		w.mu.Unlock()
+	}
+
+	return n
+}
+
+// errSpillCorrupted is returned for the spilled messages following the one which can't be decoded
+var errSpillCorrupted = errors.New("spill file is corrupted")
+
+// spillRecord is the message written to the spill file, one of the fields is set
+type spillRecord struct {
+	TelemetryMessage         *TelemetryMessage
+	ExtendedTelemetryMessage *ExtendedTelemetryMessage
+}
+
+// spillFile is the queue of the messages stored in a temporary file, which is created on the first write.
+// The connections of the messages are kept in memory, their number is bounded by the spill limit.
+type spillFile struct {
+	// failed is set once the write fails, it's guarded by the worker mutex
+	failed bool
+
+	// mu guards the writer and the connections of the written messages, f is appended by the pushers
+	mu    sync.Mutex
+	f     *os.File
+	enc   *gob.Encoder
+	conns []*Conn
+
+	// r is read by the worker only
+	r       *os.File
+	dec     *gob.Decoder
+	corrupt bool
+}
+
+func (s *spillFile) open(dir string) error {
+	f, err := os.CreateTemp(dir, "ntcb-spill-*")
+	if err != nil {
+		return err
+	}
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	s.f, s.r = f, r
+	s.enc, s.dec = gob.NewEncoder(f), gob.NewDecoder(r)
+
+	return nil
+}
+
+func (s *spillFile) write(dir string, c *Conn, r *spillRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		if err := s.open(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := s.enc.Encode(r); err != nil {
+		return err
+	}
+	s.conns = append(s.conns, c)
+
+	return nil
+}
+
+// read decodes the oldest message, the records are written unbuffered, so the written ones are always complete
+func (s *spillFile) read(j *job) error {
+	s.mu.Lock()
+	c := s.conns[0]
+	s.conns[0] = nil
+	s.conns = s.conns[1:]
+	s.mu.Unlock()
+
+	if s.corrupt {
+		return errSpillCorrupted
+	}
+
+	var r spillRecord
+	if err := s.dec.Decode(&r); err != nil {
+		s.corrupt = true
+		return err
+	}
+
+	*j = job{c: c}
+	if r.ExtendedTelemetryMessage != nil {
+		j.extended, j.etm = true, *r.ExtendedTelemetryMessage
+	} else if r.TelemetryMessage != nil {
+		j.tm = *r.TelemetryMessage
+	}
+
+	return nil
+}
+
+// remove deletes the file once no message is spilled or being spilled
+func (s *spillFile) remove() {
+	if s.f == nil {
+		return
+	}
+
+	_ = s.f.Close()
+	_ = s.r.Close()
+	_ = os.Remove(s.f.Name())
+}
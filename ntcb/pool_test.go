@@ -0,0 +1,230 @@
+package ntcb
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	t.Run("spill keeps device order", func(t *testing.T) {
+		dir := t.TempDir()
+
+		var (
+			mu      sync.Mutex
+			handled = map[string][]uint32{}
+			release = make(chan struct{})
+		)
+		p := newWorkerPool(&ServerOptions{Workers: 4, QueueSize: 2, Backpressure: BackpressureSpill, SpillDir: dir},
+			func(j *job) {
+				<-release
+				seqNo := j.tm.SeqNo
+				if j.extended {
+					seqNo = j.etm.SeqNo
+				}
+
+				mu.Lock()
+				handled[j.c.id] = append(handled[j.c.id], seqNo)
+				mu.Unlock()
+			})
+
+		conns := []*Conn{{id: "100000000000001"}, {id: "100000000000002"}, {id: "100000000000003"}}
+		for i := uint32(0); i < 50; i++ {
+			for _, c := range conns {
+				if i%2 == 0 {
+					p.pushTelemetryMessage(c, &TelemetryMessage{RawTelemetryMessage: RawTelemetryMessage{SeqNo: i}})
+				} else {
+					tm := &ExtendedTelemetryMessage{}
+					tm.SeqNo = i
+					p.pushExtendedTelemetryMessage(c, tm)
+				}
+			}
+		}
+
+		if p.spilled() == 0 {
+			t.Errorf("expected spilled messages")
+		}
+		// the workers may have taken a message of every device
+		if n := p.queued(); n < 150-len(conns) {
+			t.Errorf("unexpected queued messages, %d", n)
+		}
+
+		close(release)
+		p.close()
+		<-p.wait()
+
+		for _, c := range conns {
+			seqNos := handled[c.id]
+			if len(seqNos) != 50 {
+				t.Fatalf("unexpected number of handled messages of %s, %d", c.id, len(seqNos))
+			}
+			for i, seqNo := range seqNos {
+				if seqNo != uint32(i) {
+					t.Fatalf("unexpected order of the messages of %s, %v", c.id, seqNos)
+				}
+			}
+		}
+
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Errorf("spill files are not removed, %v", files)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		var (
+			handled []uint32
+			started = make(chan struct{}, 5)
+			release = make(chan struct{})
+		)
+		p := newWorkerPool(&ServerOptions{Workers: 1, QueueSize: 2, Backpressure: BackpressureDropOldest},
+			func(j *job) {
+				started <- struct{}{}
+				<-release
+				handled = append(handled, j.tm.SeqNo)
+			})
+
+		c := &Conn{id: "100000000000001"}
+		p.pushTelemetryMessage(c, &TelemetryMessage{RawTelemetryMessage: RawTelemetryMessage{SeqNo: 1}})
+		<-started
+		for i := uint32(2); i <= 5; i++ {
+			p.pushTelemetryMessage(c, &TelemetryMessage{RawTelemetryMessage: RawTelemetryMessage{SeqNo: i}})
+		}
+
+		close(release)
+		p.close()
+		<-p.wait()
+
+		if len(handled) != 3 || handled[0] != 1 || handled[1] != 4 || handled[2] != 5 {
+			t.Errorf("unexpected handled messages, %v", handled)
+		}
+		if p.dropped != 2 {
+			t.Errorf("unexpected dropped messages, %d", p.dropped)
+		}
+	})
+
+	t.Run("drop oldest keeps other devices", func(t *testing.T) {
+		var (
+			handled []string
+			started = make(chan struct{}, 5)
+			release = make(chan struct{})
+		)
+		p := newWorkerPool(&ServerOptions{Workers: 1, QueueSize: 2, Backpressure: BackpressureDropOldest},
+			func(j *job) {
+				started <- struct{}{}
+				<-release
+				handled = append(handled, fmt.Sprintf("%s/%d", j.c.id[14:], j.tm.SeqNo))
+			})
+
+		a, b := &Conn{id: "100000000000001"}, &Conn{id: "100000000000002"}
+		p.pushTelemetryMessage(a, &TelemetryMessage{RawTelemetryMessage: RawTelemetryMessage{SeqNo: 1}})
+		<-started
+		p.pushTelemetryMessage(b, &TelemetryMessage{RawTelemetryMessage: RawTelemetryMessage{SeqNo: 1}})
+		p.pushTelemetryMessage(b, &TelemetryMessage{RawTelemetryMessage: RawTelemetryMessage{SeqNo: 2}})
+
+		// the queue holds no message of the device, so it's blocked instead of dropping the other device ones
+		pushed := make(chan struct{})
+		go func() {
+			p.pushTelemetryMessage(a, &TelemetryMessage{RawTelemetryMessage: RawTelemetryMessage{SeqNo: 2}})
+			close(pushed)
+		}()
+
+		select {
+		case <-pushed:
+			t.Fatalf("push isn't blocked by the queue of the other device")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		<-pushed
+		p.close()
+		<-p.wait()
+
+		if !reflect.DeepEqual(handled, []string{"1/1", "2/1", "2/2", "1/2"}) {
+			t.Errorf("unexpected handled messages, %v", handled)
+		}
+		if p.dropped != 0 {
+			t.Errorf("unexpected dropped messages, %d", p.dropped)
+		}
+	})
+
+	t.Run("spill limit", func(t *testing.T) {
+		release := make(chan struct{})
+		p := newWorkerPool(&ServerOptions{Workers: 1, QueueSize: 1, Backpressure: BackpressureSpill,
+			SpillDir: t.TempDir(), SpillLimit: 2}, func(j *job) { <-release })
+
+		// the first message is taken by the worker or queued, the next ones are queued and spilled
+		c := &Conn{id: "100000000000001"}
+		for i := 0; i < 3; i++ {
+			p.pushTelemetryMessage(c, &TelemetryMessage{})
+		}
+
+		pushed := make(chan struct{})
+		go func() {
+			p.pushTelemetryMessage(c, &TelemetryMessage{})
+			p.pushTelemetryMessage(c, &TelemetryMessage{})
+			close(pushed)
+		}()
+
+		select {
+		case <-pushed:
+			t.Fatalf("push isn't blocked by the spill limit")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if n := p.spilled(); n != 2 {
+			t.Errorf("unexpected spilled messages, %d", n)
+		}
+
+		close(release)
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			t.Fatalf("push isn't unblocked")
+		}
+		p.close()
+		<-p.wait()
+	})
+
+	t.Run("block", func(t *testing.T) {
+		release := make(chan struct{})
+		p := newWorkerPool(&ServerOptions{Workers: 1, QueueSize: 1}, func(j *job) { <-release })
+		defer p.close()
+
+		c := &Conn{id: "100000000000001"}
+		p.pushTelemetryMessage(c, &TelemetryMessage{})
+		p.pushTelemetryMessage(c, &TelemetryMessage{})
+
+		pushed := make(chan struct{})
+		go func() {
+			p.pushTelemetryMessage(c, &TelemetryMessage{})
+			close(pushed)
+		}()
+
+		select {
+		case <-pushed:
+			t.Fatalf("push isn't blocked by the full queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			t.Fatalf("push isn't unblocked")
+		}
+	})
+}
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	for _, p := range []BackpressurePolicy{BackpressureBlock, BackpressureDropOldest, BackpressureSpill} {
+		if parsed, err := ParseBackpressurePolicy(p.String()); err != nil || parsed != p {
+			t.Errorf("unexpected policy parsed from %q, %v, %v", p.String(), parsed, err)
+		}
+	}
+
+	if _, err := ParseBackpressurePolicy("unknown"); err == nil {
+		t.Errorf("expected error parsing unknown policy")
+	}
+}
@@ -0,0 +1,165 @@
+package ntcb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidProxyHeader closes the connection from the trusted source which doesn't start with a PROXY header
+var ErrInvalidProxyHeader = ProtocolError("invalid PROXY protocol header")
+
+const (
+	// proxyV1MaxSize is the maximum size of the v1 header including CRLF
+	proxyV1MaxSize = 107
+	// proxyV2HeaderSize is the size of the v2 signature, version, command, family and length
+	proxyV2HeaderSize = 16
+	// proxyV2MaxAddressSize limits the addresses and TLVs of the v2 header
+	proxyV2MaxAddressSize = 1024
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is the connection accepted from the load balancer, it reports the address of the device
+type proxyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	// data buffered while reading the header
+	pending []byte
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// trustedProxy reports whether the connection source may send the PROXY header, no source is trusted if
+// the networks are empty, otherwise any client could forge its address
+func trustedProxy(addr net.Addr, nets []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header, the returned connection reports the source address
+// from the header unless it's a health check of the load balancer or the source is unknown
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	br := bufio.NewReaderSize(conn, proxyV1MaxSize+1)
+	prefix, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		if err == io.EOF {
+			err = ErrInvalidProxyHeader
+		}
+		return nil, err
+	}
+
+	var addr net.Addr
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		addr, err = readProxyV2Header(br)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		addr, err = readProxyV1Header(br)
+	default:
+		err = ErrInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{Conn: conn, remoteAddr: addr}
+	if pc.remoteAddr == nil {
+		pc.remoteAddr = conn.RemoteAddr()
+	}
+	if n := br.Buffered(); n > 0 {
+		pending, _ := br.Peek(n)
+		pc.pending = append([]byte(nil), pending...)
+	}
+
+	return pc, nil
+}
+
+// readProxyV1Header reads the header e.g. PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1Header(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxSize || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads the binary header, TLVs are skipped
+func readProxyV2Header(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	verCmd, family, size := header[12], header[13], int(binary.BigEndian.Uint16(header[14:]))
+	if verCmd>>4 != 2 || size > proxyV2MaxAddressSize {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	addresses := make([]byte, size)
+	if _, err := io.ReadFull(br, addresses); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// LOCAL command is sent by the load balancer itself e.g. health checks
+	if verCmd&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	// TCP over IPv4: source (4) + destination (4) + source port (2) + destination port (2)
+	case 0x11:
+		if size < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	// TCP over IPv6: source (16) + destination (16) + source port (2) + destination port (2)
+	case 0x21:
+		if size < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	}
+
+	// unspecified or unsupported family, the address of the connection is kept
+	return nil, nil
+}
@@ -0,0 +1,136 @@
+package ntcb
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(cmd byte, src *net.TCPAddr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|cmd, 0x11, 0, 12)
+	header = append(header, src.IP.To4()...)
+	header = append(header, 10, 0, 0, 1)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], 8080)
+	return append(header, ports...)
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	device := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40001}
+	_, trusted, _ := net.ParseCIDR("192.168.0.0/16")
+
+	tests := []struct {
+		name       string
+		source     string
+		header     []byte
+		remoteAddr string
+		err        error
+	}{
+		{
+			name:       "v1",
+			source:     "192.168.0.1:5000",
+			header:     []byte("PROXY TCP4 203.0.113.7 10.0.0.1 40001 8080\r\n"),
+			remoteAddr: device.String(),
+		},
+		{
+			name:       "v1 unknown",
+			source:     "192.168.0.1:5000",
+			header:     []byte("PROXY UNKNOWN\r\n"),
+			remoteAddr: "192.168.0.1:5000",
+		},
+		{
+			name:       "v2",
+			source:     "192.168.0.1:5000",
+			header:     proxyV2Header(1, device),
+			remoteAddr: device.String(),
+		},
+		{
+			name:       "v2 local",
+			source:     "192.168.0.1:5000",
+			header:     proxyV2Header(0, device),
+			remoteAddr: "192.168.0.1:5000",
+		},
+		{
+			name:       "untrusted source",
+			source:     "198.51.100.1:5000",
+			remoteAddr: "198.51.100.1:5000",
+		},
+		{
+			name:   "missing header",
+			source: "192.168.0.1:5000",
+			err:    ErrInvalidProxyHeader,
+		},
+		{
+			name:   "invalid v1 header",
+			source: "192.168.0.1:5000",
+			header: []byte("PROXY TCP4 203.0.113.7\r\n"),
+			err:    ErrInvalidProxyHeader,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connected := make(chan string, 1)
+			closed := make(chan error, 1)
+			s := NewServer(ServerOptions{
+				ProxyProtocol:    true,
+				ProxyTrustedNets: []*net.IPNet{trusted},
+				OnNewConnection: func(c *Conn) {
+					connected <- c.RemoteAddr()
+				},
+				OnConnectionClosed: func(c *Conn, err error) {
+					closed <- err
+				},
+			})
+
+			serverConn, deviceConn := net.Pipe()
+			defer deviceConn.Close()
+			source, _ := net.ResolveTCPAddr("tcp", tt.source)
+			s.handleNewConnection(remoteAddrConn{Conn: serverConn, addr: source})
+
+			// header and the handshake are sent in a single segment
+			go func() {
+				_, _ = deviceConn.Write(append(tt.header, NewEncoder(nil).Handshake("100000000000000")...))
+				_, _ = io.Copy(io.Discard, deviceConn)
+			}()
+
+			if tt.err != nil {
+				select {
+				case err := <-closed:
+					if err != tt.err {
+						t.Errorf("got error %v, want %v", err, tt.err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("connection is not closed")
+				}
+				return
+			}
+
+			select {
+			case addr := <-connected:
+				if addr != tt.remoteAddr {
+					t.Errorf("got remote address %s, want %s", addr, tt.remoteAddr)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("device is not connected")
+			}
+			s.Stop()
+		})
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("192.168.0.0/24")
+	addr, _ := net.ResolveTCPAddr("tcp", "192.168.0.1:5000")
+
+	if trustedProxy(addr, nil) {
+		t.Errorf("unexpected trusted source without trusted networks")
+	}
+	if !trustedProxy(addr, []*net.IPNet{trusted}) {
+		t.Errorf("unexpected untrusted source of the trusted network")
+	}
+}
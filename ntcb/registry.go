@@ -0,0 +1,128 @@
+package ntcb
+
+import (
+	"fmt"
+	"net"
+)
+
+// ErrDuplicateDevice closes the connection of the device which is already connected with DuplicateReject policy
+var ErrDuplicateDevice = ProtocolError("device is already connected")
+
+// ErrReplaced closes the previous connection of the device with DuplicateReplace policy
+var ErrReplaced = ProtocolError("connection is replaced by the new connection of the device")
+
+// DuplicatePolicy defines what happens when the device connects while its previous connection is still alive,
+// e.g. the device reconnected before the old TCP session died
+type DuplicatePolicy int
+
+const (
+	// DuplicateReplace closes the previous connection and registers the new one
+	DuplicateReplace DuplicatePolicy = iota
+	// DuplicateReject closes the new connection before the handshake reply
+	DuplicateReject
+	// DuplicateAllow keeps all the connections, the device is addressed with the newest one
+	DuplicateAllow
+)
+
+func (p DuplicatePolicy) String() string {
+	switch p {
+	case DuplicateReplace:
+		return "replace"
+	case DuplicateReject:
+		return "reject"
+	case DuplicateAllow:
+		return "allow"
+	}
+
+	return fmt.Sprintf("DuplicatePolicy(%d)", int(p))
+}
+
+// ParseDuplicatePolicy parses the policy name: replace, reject or allow
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch s {
+	case "", "replace":
+		return DuplicateReplace, nil
+	case "reject":
+		return DuplicateReject, nil
+	case "allow":
+		return DuplicateAllow, nil
+	}
+
+	return DuplicateReplace, fmt.Errorf("unknown duplicate policy %q", s)
+}
+
+// register adds the connection passed the handshake to the registry applying the duplicate policy,
+// connections of the device are kept in the order they're connected
+func (s *Server) register(c *Conn) error {
+	s.connMu.Lock()
+	prevs := s.conns[c.id]
+	for _, prev := range prevs {
+		if prev == c {
+			s.connMu.Unlock()
+			return nil
+		}
+	}
+
+	policy := s.opts.DuplicatePolicy
+	if len(prevs) == 0 || policy != DuplicateReject {
+		s.conns[c.id] = append(prevs, c)
+	}
+	s.connMu.Unlock()
+
+	for _, prev := range prevs {
+		if host(prev.RemoteAddr()) != host(c.RemoteAddr()) {
+			s.handlePossibleClone(c, prev)
+		}
+	}
+
+	switch {
+	case len(prevs) == 0:
+	case policy == DuplicateReject:
+		return ErrDuplicateDevice
+	case policy == DuplicateReplace:
+		for _, prev := range prevs {
+			prev.closeWith(ErrReplaced)
+		}
+	}
+
+	return nil
+}
+
+// unregister removes the connection from the registry, the other connections of the device are kept
+func (s *Server) unregister(c *Conn) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	conns := s.conns[c.id]
+	for i, registered := range conns {
+		if registered == c {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+
+	if len(conns) == 0 {
+		delete(s.conns, c.id)
+	} else {
+		s.conns[c.id] = conns
+	}
+}
+
+func (s *Server) handlePossibleClone(c *Conn, prev *Conn) {
+	if s.opts.OnPossibleClone == nil {
+		return
+	}
+
+	defer s.recoverConn(c)
+
+	s.opts.OnPossibleClone(c, prev)
+}
+
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return h
+}
@@ -0,0 +1,114 @@
+package ntcb
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// remoteAddrConn is the pipe with the remote address of a TCP connection
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// connectDeviceFrom connects the device from the address and performs the handshake, the handshake reply
+// is awaited unless the device is rejected
+func connectDeviceFrom(t *testing.T, s *Server, addr string) (net.Conn, *Conn) {
+	serverConn, deviceConn := net.Pipe()
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+
+	c := s.handleNewConnection(remoteAddrConn{Conn: serverConn, addr: tcpAddr})
+	if _, err := deviceConn.Write(NewEncoder(nil).Handshake("100000000000000")); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, ntcbHeaderSize+3)
+	_, _ = io.ReadFull(deviceConn, reply)
+	go func() {
+		_, _ = io.Copy(io.Discard, deviceConn)
+	}()
+
+	return deviceConn, c
+}
+
+func TestServerDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		policy      DuplicatePolicy
+		prevErr     error
+		newErr      error
+		activeConns int
+	}{
+		{policy: DuplicateReplace, prevErr: ErrReplaced, activeConns: 1},
+		{policy: DuplicateReject, newErr: ErrDuplicateDevice, activeConns: 1},
+		{policy: DuplicateAllow, activeConns: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			closed := make(chan error, 2)
+			closedConns := make(chan *Conn, 2)
+			clones := make(chan *Conn, 2)
+			s := NewServer(ServerOptions{
+				DuplicatePolicy: tt.policy,
+				OnConnectionClosed: func(c *Conn, err error) {
+					closedConns <- c
+					closed <- err
+				},
+				OnPossibleClone: func(c *Conn, prev *Conn) {
+					clones <- prev
+				},
+			})
+
+			prevDevice, prev := connectDeviceFrom(t, s, "10.0.0.1:5000")
+			defer prevDevice.Close()
+			newDevice, c := connectDeviceFrom(t, s, "10.0.0.2:5000")
+			defer newDevice.Close()
+
+			if clone := <-clones; clone != prev {
+				t.Errorf("possible clone is not reported")
+			}
+
+			expectedClosed, expectedErr := prev, tt.prevErr
+			if tt.newErr != nil {
+				expectedClosed, expectedErr = c, tt.newErr
+			}
+			if expectedErr != nil {
+				select {
+				case closedConn := <-closedConns:
+					if err := <-closed; closedConn != expectedClosed || err != expectedErr {
+						t.Errorf("unexpected connection closed, %v", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("duplicate connection is not closed")
+				}
+			}
+
+			if conns := s.Conns(); len(conns) != tt.activeConns {
+				t.Fatalf("unexpected number of active connections %d", len(conns))
+			}
+
+			expectedActive := c
+			if tt.newErr != nil {
+				expectedActive = prev
+			}
+			if active, ok := s.Conn("100000000000000"); !ok || active != expectedActive {
+				t.Errorf("unexpected active connection")
+			}
+
+			// closed previous connection doesn't remove the active one
+			_ = prevDevice.Close()
+			if tt.policy == DuplicateAllow {
+				<-closed
+				if active, ok := s.Conn("100000000000000"); !ok || active != c {
+					t.Errorf("active connection is removed with the previous one")
+				}
+			}
+		})
+	}
+}
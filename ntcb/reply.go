@@ -0,0 +1,218 @@
+package ntcb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type protoNegotiationMsg struct {
+	Pre             [6]byte
+	Protocol        uint8
+	ProtocolVersion uint8
+	StructVersion   uint8
+}
+
+// handleFrame applies the decoded frame to the connection state, passes the telemetry to the handlers
+// and replies to the device
+func (c *Conn) handleFrame(f *Frame) error {
+	switch f.Type {
+	case FrameTypeHandshake:
+		c.id = f.DeviceID
+		c.header = f.Header
+
+		// the device is not replied if it's not admitted
+		if c.admit != nil {
+			if err := c.admit(c); err != nil {
+				return err
+			}
+		}
+
+		if err := c.writeNTCBReply(f.Header, []byte("*<S")); err != nil {
+			return err
+		}
+		c.hooks().Handshake(c)
+
+		return nil
+	case FrameTypeProtocolNegotiation:
+		return c.handleProtocolNegotiation(f)
+	case FrameTypeCommandResponse:
+		return c.handleCommandResponse(f.Body)
+	case FrameTypePing:
+		if c.Debug() {
+			c.log(LevelDebug, "ping")
+		}
+		atomic.StoreInt64(&c.lastPingAt, time.Now().UnixNano())
+		c.hooks().Ping(c)
+
+		return nil
+	case FrameTypeTelemetry:
+		if f.MessageType == MessageTypeCurrent {
+			return c.handleCurrentState(f)
+		}
+		if err := c.deliverTelemetryMessages(f.TelemetryMessages); err != nil {
+			return err
+		}
+
+		return c.ack(f)
+	case FrameTypeExtendedTelemetry:
+		if err := c.deliverExtendedTelemetryMessages(f.ExtendedTelemetryMessages); err != nil {
+			return err
+		}
+
+		return c.ack(f)
+	}
+
+	if c.Debug() {
+		c.log(LevelDebug, "unrecognized NTCB message", Field{"bytes", len(f.Body)}, Field{"msg", f.Body})
+	}
+
+	return nil
+}
+
+// ack acknowledges the telemetry frame
+func (c *Conn) ack(f *Frame) error {
+	if err := c.writeFlexReply(f.Raw[:2], flexReplyBody(f)); err != nil {
+		return err
+	}
+	c.hooks().AckSent(c, f)
+
+	return nil
+}
+
+// flexReplyBody returns the part of the flex message the device expects back, event index of the single
+// messages or count of the arrays
+func flexReplyBody(f *Frame) []byte {
+	switch f.MessageType {
+	case MessageTypeAlarming, MessageTypeExtendedAlarming:
+		return f.Raw[2:6]
+	case MessageTypeArray, MessageTypeExtendedArray:
+		return f.Raw[2:3]
+	}
+
+	return nil
+}
+
+func (c *Conn) handleProtocolNegotiation(f *Frame) error {
+	n := f.Negotiation
+	if n.Protocol != flexProtocol {
+		// there is no reply for the protocol the server can't talk
+		return FrameError{Kind: FrameErrorUnsupportedVersion, Msg: fmt.Sprintf("unsupported protocol %s", hex.EncodeToString([]byte{n.Protocol})), Fatal: true}
+	}
+
+	protoVersion, ok := c.negotiateFlexVersion(n.ProtocolVersion)
+	structVersion, structOk := c.negotiateFlexVersion(n.StructVersion)
+	if !ok || !structOk {
+		// there is no reply for the versions the listener doesn't allow
+		return FrameError{Kind: FrameErrorUnsupportedVersion, Msg: fmt.Sprintf("FLEX version %d.%d or struct version %d.%d is not allowed", n.ProtocolVersion/10, n.ProtocolVersion%10, n.StructVersion/10, n.StructVersion%10), Fatal: true}
+	}
+
+	bitField := NegotiatedBitField(n.BitField, structVersion)
+
+	c.stateMu.Lock()
+	c.proto, c.dataSize = n.Protocol, n.DataSize
+	c.protoVersion, c.structVersion = protoVersion, structVersion
+	c.flexBitField = bitField
+	c.dec().SetBitField(bitField)
+	c.stateMu.Unlock()
+
+	err := c.writeNTCBReply(f.Header, protoNegotiationMsg{
+		Pre:             [6]byte{'*', '<', 'F', 'L', 'E', 'X'},
+		Protocol:        c.proto,
+		ProtocolVersion: c.protoVersion,
+		StructVersion:   c.structVersion,
+	})
+	if err != nil {
+		return err
+	}
+	c.hooks().Negotiated(c, n)
+
+	return nil
+}
+
+// NegotiatedBitField returns the bit field the device sends the records with once the struct version is negotiated,
+// the device which falls back to the FLEX 1.0 struct doesn't send the fields it proposed past it
+func NegotiatedBitField(proposed BitArray, structVersion uint8) BitArray {
+	if structVersion == flexProtocolVersion10 {
+		return proposed.truncate(FlexFieldCount10)
+	}
+
+	return proposed
+}
+
+// negotiateFlexVersion returns the proposed version if it's supported, otherwise falls back to the highest
+// supported version below it or FLEX 1.0, protocol and struct versions are negotiated independently. The version
+// the listener doesn't allow falls back to the lower allowed one, false is returned if there is none.
+func (c *Conn) negotiateFlexVersion(v uint8) (uint8, bool) {
+	if v < flexProtocolVersion10 {
+		v = flexProtocolVersion10
+	}
+
+	for _, version := range [...]uint8{flexProtocolVersion20, flexProtocolVersion10} {
+		if version <= v && c.listener.allowsFlexVersion(version) {
+			return version, true
+		}
+	}
+
+	return 0, false
+}
+
+func (c *Conn) writeNTCBReply(h Header, body interface{}) error {
+	var bodyBuff bytes.Buffer
+	if err := binary.Write(&bodyBuff, binary.LittleEndian, body); err != nil {
+		return err
+	}
+
+	// reply swaps the sender and the receiver
+	msg := appendNTCBMessage(nil, Header{Pre: h.Pre, IDr: h.IDs, IDs: h.IDr}, bodyBuff.Bytes())
+
+	c.writeMu.Lock()
+	n, err := c.conn.Write(msg)
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	c.countWrite(n)
+	c.hooks().FrameOut(c, msg)
+
+	if c.Debug() {
+		c.log(LevelDebug, "message sent", Field{"bytes", bodyBuff.Len()}, Field{"msg", bodyBuff.Bytes()})
+	}
+
+	return nil
+}
+
+func (c *Conn) writeFlexReply(flexHeader []byte, body []byte) error {
+	c.writeMu.Lock()
+
+	// reply buffer is reused, it's guarded by the write mutex
+	c.replyBuf = append(append(c.replyBuf[:0], flexHeader...), body...)
+	c.replyBuf = append(c.replyBuf, CRC8(c.replyBuf))
+
+	n, err := c.conn.Write(c.replyBuf)
+
+	// the handler gets a copy, the buffer is overwritten by the next reply once the mutex is released
+	var out []byte
+	if err == nil && c.handler != nil {
+		out = append([]byte(nil), c.replyBuf...)
+	}
+
+	if c.Debug() {
+		c.log(LevelDebug, "message sent", Field{"bytes", len(c.replyBuf)}, Field{"msg", c.replyBuf})
+	}
+	c.writeMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	c.countWrite(n)
+	if out != nil {
+		// the hook is called without the write mutex, so it may write to the connection
+		c.handler.FrameOut(c, out)
+	}
+
+	return nil
+}
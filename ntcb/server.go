@@ -1,81 +1,357 @@
 package ntcb
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
-	"os"
-	"os/signal"
 	"sort"
 	"sync"
-	"syscall"
+	"time"
 )
 
 type ServerOptions struct {
-	Debug              bool
-	Address            string
-	OnTelemetryMessage func(c *Conn, tm TelemetryMessage)
-	OnNewConnection    func(c *Conn)
-	OnConnectionClosed func(c *Conn, err error)
-	OnConnectionError  func(c *Conn, err error)
+	// Logger writes the entries of the connections, the standard logger is used if it's nil
+	Logger Logger
+	// Debug writes the debug entries of all the connections, DebugDevices of the listed devices only,
+	// see Server.SetDeviceDebug to debug the devices at runtime
+	Debug                      bool
+	DebugDevices               []string
+	Address                    string
+	OnTelemetryMessage         func(c *Conn, tm TelemetryMessage)
+	OnExtendedTelemetryMessage func(c *Conn, tm ExtendedTelemetryMessage)
+	OnDeviceInfo               func(c *Conn, info DeviceInfo)
+	OnNewConnection            func(c *Conn)
+	OnConnectionClosed         func(c *Conn, err error)
+	OnConnectionError          func(c *Conn, err error)
+
+	// AckPolicy defines when the FLEX telemetry is acknowledged. With AckOnPersist the telemetry is passed to
+	// PersistTelemetryMessages and PersistExtendedTelemetryMessages instead of the On* handlers, they're called by
+	// the read loop with the records of a single message, which are valid until the handler returns. The device
+	// isn't read meanwhile, so the read, ping and idle timeouts are counted from the end of the persist.
+	AckPolicy                        AckPolicy
+	PersistTelemetryMessages         func(c *Conn, tms []TelemetryMessage) error
+	PersistExtendedTelemetryMessages func(c *Conn, tms []ExtendedTelemetryMessage) error
+
+	// IdleTimeout reports the device which sent nothing for the duration with OnDeviceIdle, once per idle period
+	IdleTimeout  time.Duration
+	OnDeviceIdle func(c *Conn, idle time.Duration)
+	// ReadTimeout closes the connection of the device which sent nothing for the duration, PingTimeout closes
+	// the connection of the device which stopped pinging. OnDeviceTimeout is called before the connection is closed
+	// with ErrReadTimeout or ErrPingTimeout.
+	ReadTimeout     time.Duration
+	PingTimeout     time.Duration
+	OnDeviceTimeout func(c *Conn, err error)
+	// TLSConfig enables TLS on the device connections. If the client certificate is verified, the device ID
+	// from the handshake must be its common name or DNS name.
+	TLSConfig *tls.Config
+	// TCPKeepAlive sets the keep-alive period of the accepted connections, zero keeps the default period,
+	// negative disables keep-alive
+	TCPKeepAlive time.Duration
+
+	// DuplicatePolicy defines what happens when the device connects while its previous connection is alive,
+	// OnPossibleClone is called when the connections are from different IPs, which may be a cloned IMEI
+	DuplicatePolicy DuplicatePolicy
+	OnPossibleClone func(c *Conn, prev *Conn)
+
+	// CurrentStatePollInterval enables periodic current state requests to every connected device
+	CurrentStatePollInterval time.Duration
+	// Resync makes connections skip the bytes which don't start a valid frame instead of closing the connection,
+	// connection is closed once more than MaxGarbageBytes are skipped in a row, zero means no limit
+	Resync          bool
+	MaxGarbageBytes int
+	// ProxyProtocol makes the connections from ProxyTrustedNets start with the PROXY protocol v1 or v2 header,
+	// the device address from the header is reported by RemoteAddr. Connections from the other sources are served
+	// as direct ones, no source is trusted if ProxyTrustedNets is empty.
+	ProxyProtocol    bool
+	ProxyTrustedNets []*net.IPNet
+	// Listeners are served by ListenAndServe sharing the registry and the handlers, Address, Debug, TLSConfig
+	// and AckPolicy configure the only listener if it's empty
+	Listeners []ListenerProfile
+	// MaxConns limits the connections of the server, MaxConnsPerIP limits the connections from an IP,
+	// zero means no limit
+	MaxConns      int
+	MaxConnsPerIP int
+	// HandshakeRate limits the handshakes per second from an IP allowing bursts of HandshakeBurst
+	HandshakeRate  float64
+	HandshakeBurst int
+	// BanThreshold bans the IP for BanDuration once its connections failed the handshake or sent malformed frames
+	// BanThreshold times with less than BanDuration between them, zero disables bans
+	BanThreshold int
+	BanDuration  time.Duration
+	OnIPBanned   func(ip string, d time.Duration)
+	// AdmitDevice is called on the handshake before the reply e.g. to allow the registered devices only,
+	// the connection is closed if an error is returned
+	AdmitDevice func(c *Conn) error
+	// Middlewares are the stages of the handler chain of the connections, the first one is the outermost.
+	// The chain ends with Handler, or with OnTelemetryMessage, OnExtendedTelemetryMessage and the persist
+	// callbacks if it's nil.
+	Middlewares []Middleware
+	Handler     Handler
+	// Workers pass the telemetry acknowledged on receive to the handlers, the messages of a device are handled
+	// by the same worker in order. QueueSize bounds the queue of every worker and Backpressure defines what
+	// happens when it's full, SpillDir keeps the spill files of BackpressureSpill, the temporary directory is used
+	// if it's empty. SpillLimit bounds the spilled messages of a worker. The defaults are 32 workers with
+	// the queues of 128 messages and the spill limit of 65536 messages.
+	Workers      int
+	QueueSize    int
+	Backpressure BackpressurePolicy
+	SpillDir     string
+	SpillLimit   int
+	// Metrics observes the connections, see Metrics
+	Metrics Metrics
+	// SessionDir enables recording of the raw device sessions, a file per connection which passed the handshake
+	// is created in the directory
+	SessionDir string
 }
 
+// ErrServerClosed is returned by ListenAndServe after Shutdown and closes the connections on shutdown
+var ErrServerClosed = ProtocolError("server closed")
+
 type Server struct {
-	opts   ServerOptions
-	conns  map[string]*Conn
+	opts ServerOptions
+	// listener serving the connections passed to Serve
+	listener  *listener
+	admission *admission
+	// handler chain of the connections ending with the callbacks of the options
+	handler Handler
+	// pool of the workers passing the queued telemetry to the handler
+	pool *workerPool
+	// connections of the devices passed the handshake, the last one is the newest
+	conns  map[string][]*Conn
 	connMu sync.Mutex
-	close  chan struct{}
+	// debug settings of the devices overriding the listener one
+	debugDevices map[string]bool
+
+	// lifecycle state, all the accepted connections and the goroutines serving them
+	mu        sync.Mutex
+	shutdown  bool
+	listeners []net.Listener
+	active    map[*Conn]struct{}
+	wg        sync.WaitGroup
+	// ctx of the requests sent to the devices, it's cancelled on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (s *Server) ActiveDeviceIDs() []string {
+	s.connMu.Lock()
 	IDs := make([]string, 0, len(s.conns))
 	for ID := range s.conns {
 		IDs = append(IDs, ID)
 	}
+	s.connMu.Unlock()
 
 	sort.Strings(IDs)
 
 	return IDs
 }
 
+// Conns returns the connections of the devices passed the handshake ordered by device ID, a device may have
+// several connections with DuplicateAllow policy
+func (s *Server) Conns() []*Conn {
+	s.connMu.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, deviceConns := range s.conns {
+		conns = append(conns, deviceConns...)
+	}
+	s.connMu.Unlock()
+
+	// connections of the same device are kept in the order they're connected
+	sort.SliceStable(conns, func(i, j int) bool {
+		return conns[i].DeviceID() < conns[j].DeviceID()
+	})
+
+	return conns
+}
+
+// ConnInfos returns the snapshots of the connections ordered by device ID
+func (s *Server) ConnInfos() []ConnInfo {
+	conns := s.Conns()
+	infos := make([]ConnInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.Info()
+	}
+
+	return infos
+}
+
+// Conn returns the connection of the device with the given ID, the newest one if there are several
+func (s *Server) Conn(deviceID string) (*Conn, bool) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	conns := s.conns[deviceID]
+	if len(conns) == 0 {
+		return nil, false
+	}
+
+	return conns[len(conns)-1], true
+}
+
+// SendCommand sends the command to the connected device and waits for its reply
+func (s *Server) SendCommand(ctx context.Context, deviceID string, cmd Command) ([]byte, error) {
+	c, ok := s.Conn(deviceID)
+	if !ok {
+		return nil, ErrDeviceNotConnected
+	}
+
+	return c.SendCommand(ctx, cmd)
+}
+
+// RequestCurrentState requests the current state of the connected device
+func (s *Server) RequestCurrentState(ctx context.Context, deviceID string) (TelemetryMessage, error) {
+	c, ok := s.Conn(deviceID)
+	if !ok {
+		return TelemetryMessage{}, ErrDeviceNotConnected
+	}
+
+	return c.RequestCurrentState(ctx)
+}
+
 func (s *Server) handleNewConnection(conn net.Conn) *Conn {
+	return s.handleListenerConnection(conn, s.listener)
+}
+
+func (s *Server) handleListenerConnection(conn net.Conn, l *listener) *Conn {
 	c := &Conn{
-		debug:                s.opts.Debug,
-		conn:                 conn,
-		telemetryMessageChan: make(chan TelemetryMessage, 128),
+		logger:      s.opts.Logger,
+		resync:      s.opts.Resync,
+		maxGarbage:  s.opts.MaxGarbageBytes,
+		ackPolicy:   l.AckPolicy,
+		raw:         conn,
+		conn:        conn,
+		connectedAt: time.Now(),
+		admit:       s.admit,
+		listener:    l,
+		metrics:     s.opts.Metrics,
+		handler:     s.handler,
+		done:        make(chan struct{}),
+		pool:        s.pool,
 	}
 
-	go func() {
-		for m := range c.telemetryMessageChan {
-			s.opts.OnTelemetryMessage(c, m)
+	c.SetDebug(l.Debug)
+
+	if c.ackPolicy == AckOnPersist {
+		c.persistTelemetryMessages = s.handler.PersistTelemetryMessages
+		c.persistExtendedTelemetryMessages = s.handler.PersistExtendedTelemetryMessages
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok && s.opts.TCPKeepAlive != 0 {
+		if err := setKeepAlive(tc, s.opts.TCPKeepAlive); err != nil && s.opts.OnConnectionError != nil {
+			s.opts.OnConnectionError(c, err)
 		}
-	}()
+	}
+
+	if c.metrics != nil {
+		c.metrics.ConnectionAccepted(l.Name)
+	}
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		_ = conn.Close()
+		if c.metrics != nil {
+			c.metrics.ConnectionClosed(l.Name, ErrServerClosed)
+		}
+		return c
+	}
+	if s.opts.MaxConns > 0 && len(s.active) >= s.opts.MaxConns {
+		s.mu.Unlock()
+		_ = conn.Close()
+		s.connectionClosed(c, ErrTooManyConnections)
+		return c
+	}
+	s.active[c] = struct{}{}
+	// connection goroutine is awaited on shutdown, the queued telemetry is flushed by the workers after it
+	s.wg.Add(1)
+	s.mu.Unlock()
 
 	go func() {
+		defer s.wg.Done()
 
-		var connErr error
+		var (
+			connErr              error
+			ip                   string
+			admitted, handshaked bool
+		)
 
 		defer func() {
-			s.connMu.Lock()
-			delete(s.conns, c.DeviceID())
-			s.connMu.Unlock()
+			if r := recover(); r != nil {
+				connErr = newPanicError(c, r)
+			}
+
+			if admitted && s.admission.release(ip, isOffense(connErr, handshaked)) && s.opts.OnIPBanned != nil {
+				s.opts.OnIPBanned(ip, s.opts.BanDuration)
+			}
+			s.unregister(c)
+			s.mu.Lock()
+			delete(s.active, c)
+			s.mu.Unlock()
 
 			_ = c.Close()
 
-			if s.opts.OnConnectionClosed != nil {
-				s.opts.OnConnectionClosed(c, connErr)
-			}
+			s.connectionClosed(c, connErr)
 		}()
 
-		if connErr = c.handshake(); connErr != nil {
+		if connErr = s.readProxyHeader(c); connErr != nil {
+			return
+		}
+
+		ip = host(c.RemoteAddr())
+		if connErr = s.admission.accept(ip); connErr != nil {
 			return
 		}
+		admitted = true
+
+		rec := s.wrapConn(c)
+
+		connErr = c.handshake()
+		if c.metrics != nil {
+			c.metrics.Handshake(connErr)
+		}
+		if connErr != nil {
+			return
+		}
+		handshaked = true
+
+		if rec != nil {
+			if err := rec.start(c.DeviceID()); err != nil && s.opts.OnConnectionError != nil {
+				s.opts.OnConnectionError(c, err)
+			}
+		}
 
-		s.connMu.Lock()
-		s.conns[c.DeviceID()] = c
-		s.connMu.Unlock()
 		if s.opts.OnNewConnection != nil {
 			s.opts.OnNewConnection(c)
 		}
 
+		if s.opts.OnDeviceInfo != nil {
+			go func() {
+				defer s.recoverConn(c)
+
+				info, err := c.RequestDeviceInfo(s.ctx)
+				if err != nil {
+					if err != ErrConnectionClosed && s.ctx.Err() == nil && s.opts.OnConnectionError != nil {
+						s.opts.OnConnectionError(c, err)
+					}
+					return
+				}
+
+				s.opts.OnDeviceInfo(c, info)
+			}()
+		}
+
+		c.watchLiveness(livenessOptions{
+			idleTimeout: s.opts.IdleTimeout,
+			readTimeout: s.opts.ReadTimeout,
+			pingTimeout: s.opts.PingTimeout,
+			onIdle:      s.handleDeviceIdle,
+			onTimeout:   s.handleDeviceTimeout,
+		})
+
+		if s.opts.CurrentStatePollInterval > 0 {
+			c.PollCurrentState(s.opts.CurrentStatePollInterval)
+		}
+
 		if connErr = c.readLoop(); connErr != nil {
 			return
 		}
@@ -85,51 +361,337 @@ func (s *Server) handleNewConnection(conn net.Conn) *Conn {
 	return c
 }
 
-func (s *Server) ListenAndServe() error {
-	l, err := net.Listen("tcp", s.opts.Address)
+// connectionClosed reports the closed connection
+func (s *Server) connectionClosed(c *Conn, err error) {
+	if c.metrics != nil {
+		c.metrics.ConnectionClosed(c.Listener(), err)
+	}
+	if s.opts.OnConnectionClosed != nil {
+		s.opts.OnConnectionClosed(c, err)
+	}
+}
+
+// readProxyHeader reads the PROXY header of the connection from the trusted source, it's called by the connection
+// goroutine as the header is read from the network
+func (s *Server) readProxyHeader(c *Conn) (err error) {
+	defer c.replaceWithCloseReason(&err)
+
+	if !s.opts.ProxyProtocol || !trustedProxy(c.raw.RemoteAddr(), s.opts.ProxyTrustedNets) {
+		return nil
+	}
+
+	if err = c.raw.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return err
+	}
+	conn, err := readProxyHeader(c.raw)
 	if err != nil {
 		return err
 	}
+	if err = c.raw.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	c.conn = conn
+
+	return nil
+}
+
+// wrapConn wraps the admitted connection with TLS and the session recorder
+func (s *Server) wrapConn(c *Conn) *SessionRecorder {
+	if c.listener.TLSConfig != nil {
+		c.tlsConn = tls.Server(c.conn, c.listener.TLSConfig)
+		c.conn = c.tlsConn
+	}
+
+	if s.opts.SessionDir == "" {
+		return nil
+	}
 
-	interrupt := make(chan os.Signal)
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	rec := newSessionFileRecorder(s.opts.SessionDir, c.RemoteAddr())
+	c.conn = &recordingConn{Conn: c.conn, rec: rec}
 
-	newConn := make(chan net.Conn)
+	return rec
+}
 
-	go func() {
-		for {
-			conn, err := l.Accept()
+// admit applies the device settings, verifies the device passed the handshake and registers it
+func (s *Server) admit(c *Conn) error {
+	s.applyDeviceDebug(c)
+
+	if err := s.admission.handshake(host(c.RemoteAddr())); err != nil {
+		return err
+	}
+
+	if !c.listener.allowsDevice(c.id) {
+		return ErrDeviceNotAllowed
+	}
+
+	if s.opts.AdmitDevice != nil {
+		if err := s.opts.AdmitDevice(c); err != nil {
+			return err
+		}
+	}
+
+	if err := c.verifyDeviceCertificate(); err != nil {
+		return err
+	}
+
+	return s.register(c)
+}
+
+// handleJob passes the telemetry taken from the queue to the handlers
+func (s *Server) handleJob(j *job) {
+	defer s.recoverConn(j.c)
+
+	if j.extended {
+		s.handler.ExtendedTelemetryMessage(j.c, j.etm)
+		return
+	}
+	s.handler.TelemetryMessage(j.c, j.tm)
+}
+
+func (s *Server) handleDeviceIdle(c *Conn, idle time.Duration) {
+	if s.opts.OnDeviceIdle == nil {
+		return
+	}
+
+	defer s.recoverConn(c)
+
+	s.opts.OnDeviceIdle(c, idle)
+}
+
+func (s *Server) handleDeviceTimeout(c *Conn, err error) {
+	if s.opts.OnDeviceTimeout == nil {
+		return
+	}
+
+	defer s.recoverConn(c)
+
+	s.opts.OnDeviceTimeout(c, err)
+}
+
+// recoverConn is the recover boundary of the connection goroutines, the panic is reported and the connection
+// is closed, so a single device never crashes the process
+func (s *Server) recoverConn(c *Conn) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	err := newPanicError(c, r)
+	if s.opts.OnConnectionError != nil {
+		s.opts.OnConnectionError(c, err)
+	}
+
+	// read loop fails and the connection is cleaned up as usual
+	_ = c.rawConn().Close()
+}
+
+func setKeepAlive(tc *net.TCPConn, period time.Duration) error {
+	if period < 0 {
+		return tc.SetKeepAlive(false)
+	}
+
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	return tc.SetKeepAlivePeriod(period)
+}
+
+// ListenAndServe listens on the addresses of the listeners and serves the devices until the context is done or
+// the server is shut down. Nil is returned when the context is done, the connections are left to Shutdown then;
+// ErrServerClosed is returned after Shutdown. If a listener fails, the rest are closed and its error is returned.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	profiles := s.opts.Listeners
+	if len(profiles) == 0 {
+		profiles = []ListenerProfile{s.listener.ListenerProfile}
+	}
+
+	ls := make([]net.Listener, 0, len(profiles))
+	for _, p := range profiles {
+		l, err := net.Listen("tcp", p.Address)
+		if err != nil {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+			return err
+		}
+		ls = append(ls, l)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(ls))
+	for i := range ls {
+		go func(l net.Listener, p ListenerProfile) {
+			err := s.ServeListener(ctx, l, p)
 			if err != nil {
-				if s.opts.OnConnectionError != nil {
-					s.opts.OnConnectionError(nil, err)
-				}
-				continue
+				cancel()
 			}
+			errs <- err
+		}(ls[i], profiles[i])
+	}
 
-			newConn <- conn
+	var err error
+	for range ls {
+		if lerr := <-errs; err == nil {
+			err = lerr
+		}
+	}
+
+	return err
+}
+
+// Serve accepts the device connections on the listener with the server options, see ListenAndServe
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.listener)
+}
+
+// ServeListener accepts the device connections on the listener with the profile, see ListenAndServe
+func (s *Server) ServeListener(ctx context.Context, l net.Listener, p ListenerProfile) error {
+	return s.serve(ctx, l, newListener(p))
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener, profile *listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = l.Close()
+		case <-stop:
 		}
 	}()
 
+	var backoff time.Duration
 	for {
-		select {
-		case <-interrupt:
-			return nil
-		case <-s.close:
-			return nil
-		case conn := <-newConn:
-			s.handleNewConnection(conn)
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isShutdown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return err
+			}
+
+			if s.opts.OnConnectionError != nil {
+				s.opts.OnConnectionError(nil, err)
+			}
+
+			// temporary errors e.g. too many open files are retried with a growing delay
+			if backoff = 2 * backoff; backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff > time.Second {
+				backoff = time.Second
+			}
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		s.handleListenerConnection(conn, profile)
+	}
+}
+
+// Shutdown gracefully shuts the server down: the listeners are closed, connections stop reading, frames
+// in flight are handled and acknowledged, the telemetry passed to the handlers is flushed and the connections
+// are closed. If the context is done first, the connections are closed immediately and its error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	listeners := s.listeners
+	s.listeners = nil
+	conns := make([]*Conn, 0, len(s.active))
+	for c := range s.active {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	s.cancel()
+
+	for _, c := range conns {
+		c.stopReading(ErrServerClosed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		s.pool.close()
+		<-s.pool.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.active {
+			c.closeWith(ErrServerClosed)
 		}
+		s.mu.Unlock()
+
+		return ctx.Err()
 	}
 }
 
+// Stop closes the server without waiting for the frames in flight
 func (s *Server) Stop() {
-	s.close <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = s.Shutdown(ctx)
+}
+
+func (s *Server) isShutdown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shutdown
 }
 
 func NewServer(options ServerOptions) *Server {
-	return &Server{
-		opts:  options,
-		close: make(chan struct{}),
-		conns: make(map[string]*Conn, 16),
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		opts: options,
+		listener: newListener(ListenerProfile{
+			Address:   options.Address,
+			Debug:     options.Debug,
+			TLSConfig: options.TLSConfig,
+			AckPolicy: options.AckPolicy,
+		}),
+		conns:  make(map[string][]*Conn, 16),
+		active: make(map[*Conn]struct{}, 16),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.admission = newAdmission(&s.opts)
+	var h Handler = callbacksHandler{opts: &s.opts}
+	if options.Handler != nil {
+		h = options.Handler
 	}
+	s.handler = Chain(h, options.Middlewares...)
+	s.pool = newWorkerPool(&s.opts, s.handleJob)
+	s.debugDevices = make(map[string]bool, len(options.DebugDevices))
+	for _, id := range options.DebugDevices {
+		s.debugDevices[id] = true
+	}
+
+	return s
 }
@@ -0,0 +1,170 @@
+package ntcb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerRecoversPanic(t *testing.T) {
+	serverConn, deviceConn := net.Pipe()
+	defer deviceConn.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, deviceConn)
+	}()
+
+	connErr := make(chan error, 1)
+	closed := make(chan struct{})
+	s := NewServer(ServerOptions{
+		OnTelemetryMessage: func(c *Conn, tm TelemetryMessage) {
+			panic("broken handler")
+		},
+		OnConnectionError: func(c *Conn, err error) {
+			connErr <- err
+		},
+		OnConnectionClosed: func(c *Conn, err error) {
+			close(closed)
+		},
+	})
+	s.handleNewConnection(serverConn)
+
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	e := NewEncoder(ba)
+	var tm RawTelemetryMessage
+	for _, b := range [][]byte{e.Handshake("100000000000000"), e.ProtocolNegotiation(10, 10, 72), e.Current(&tm)} {
+		if _, err := deviceConn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-connErr:
+		if pe, ok := err.(*PanicError); !ok || pe.Value != "broken handler" {
+			t.Errorf("unexpected connection error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic is not reported")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestServerConnInfos(t *testing.T) {
+	s := NewServer(ServerOptions{
+		OnTelemetryMessage: func(c *Conn, tm TelemetryMessage) {},
+	})
+
+	deviceConn := connectDevice(t, s)
+	defer deviceConn.Close()
+
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	e := NewEncoder(ba)
+	var tm RawTelemetryMessage
+	corrupted := e.Alarming(1, &tm)
+	corrupted[len(corrupted)-1]++
+	for _, b := range [][]byte{e.ProtocolNegotiation(10, 10, 72), corrupted, e.Alarming(1, &tm)} {
+		if _, err := deviceConn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var info ConnInfo
+	for i := 0; i < 100; i++ {
+		if infos := s.ConnInfos(); len(infos) == 1 {
+			if info = infos[0]; info.Stats.FramesIn == 3 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if info.DeviceID != "100000000000000" || info.ConnectedAt.IsZero() || info.LastMessageAt.IsZero() {
+		t.Errorf("unexpected connection info %+v", info)
+	}
+	if info.Protocol != flexProtocol || info.ProtocolVersion != 10 || !bytes.Equal(info.BitField, ba) {
+		t.Errorf("unexpected negotiated protocol %+v", info)
+	}
+
+	// handshake, negotiation and telemetry are acknowledged
+	expected := ConnStats{FramesIn: 3, FramesOut: 3, ChecksumErrors: 1}
+	if info.Stats.BytesIn == 0 || info.Stats.BytesOut == 0 {
+		t.Errorf("unexpected traffic %+v", info.Stats)
+	}
+	info.Stats.BytesIn, info.Stats.BytesOut = 0, 0
+	if info.Stats != expected {
+		t.Errorf("unexpected connection stats %+v", info.Stats)
+	}
+
+	if ids := s.ActiveDeviceIDs(); len(ids) != 1 || ids[0] != info.DeviceID {
+		t.Errorf("unexpected active devices %v", ids)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handled int64
+	s := NewServer(ServerOptions{
+		OnTelemetryMessage: func(c *Conn, tm TelemetryMessage) {
+			// slow storage, the telemetry is still buffered on shutdown
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt64(&handled, 1)
+		},
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(context.Background(), l)
+	}()
+
+	deviceConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deviceConn.Close()
+
+	ba, _ := NewBitArrayFromString("111100011110110000110000000010000000000000000000000010111000001100011000")
+	e := NewEncoder(ba)
+	records := make([]RawTelemetryMessage, 10)
+	for _, b := range [][]byte{e.Handshake("100000000000000"), e.ProtocolNegotiation(10, 10, 72), e.Array(records)} {
+		if _, err := deviceConn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// handshake, negotiation and telemetry replies
+	reply := make([]byte, ntcbHeaderSize+3+ntcbHeaderSize+9+4)
+	if _, err := io.ReadFull(deviceConn, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected shutdown error %v", err)
+	}
+
+	if n := atomic.LoadInt64(&handled); n != int64(len(records)) {
+		t.Errorf("buffered telemetry is not flushed, %d handled", n)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("unexpected serve error %v", err)
+	}
+	if _, err := deviceConn.Read(reply); err != io.EOF {
+		t.Errorf("device connection is not closed, %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("listener is not closed")
+	}
+}
@@ -0,0 +1,242 @@
+package ntcb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SessionDirection string
+
+const (
+	// SessionDirectionIn is the data received from the device
+	SessionDirectionIn SessionDirection = "in"
+	// SessionDirectionOut is the data sent to the device
+	SessionDirectionOut SessionDirection = "out"
+)
+
+// SessionRecord is a chunk of the raw device session, sessions are stored as JSON lines of records
+type SessionRecord struct {
+	Time       time.Time        `json:"time"`
+	Direction  SessionDirection `json:"direction"`
+	RemoteAddr string           `json:"remoteAddr"`
+	DeviceID   string           `json:"deviceID,omitempty"`
+	// Data is hex encoded
+	Data string `json:"data"`
+}
+
+func (r SessionRecord) Bytes() ([]byte, error) {
+	return hex.DecodeString(r.Data)
+}
+
+// SessionRecorder writes the raw data exchanged with a device
+type SessionRecorder struct {
+	mu         sync.Mutex
+	w          io.WriteCloser
+	enc        *json.Encoder
+	remoteAddr string
+	deviceID   string
+
+	// open creates the session file once the device passes the handshake, the records are kept in pending till then
+	open    func() (io.WriteCloser, error)
+	pending []SessionRecord
+}
+
+func NewSessionRecorder(w io.WriteCloser, remoteAddr string) *SessionRecorder {
+	return &SessionRecorder{w: w, enc: json.NewEncoder(w), remoteAddr: remoteAddr}
+}
+
+// newSessionFileRecorder returns the recorder of the connection, its session file is created in the directory
+// by start, so the connections which fail the handshake leave no recordings
+func newSessionFileRecorder(dir string, remoteAddr string) *SessionRecorder {
+	r := &SessionRecorder{remoteAddr: remoteAddr}
+	r.open = func() (io.WriteCloser, error) {
+		name := fmt.Sprintf("%s_%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000"), strings.NewReplacer(":", "_", "[", "", "]", "").Replace(remoteAddr))
+		return os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	}
+
+	return r
+}
+
+// start creates the session file of the device passed the handshake and writes the records kept till then,
+// the following records are written with the device ID
+func (r *SessionRecorder) start(deviceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deviceID = deviceID
+	if r.open == nil {
+		return nil
+	}
+
+	w, err := r.open()
+	r.open = nil
+	if err != nil {
+		// the session isn't recorded
+		r.pending = nil
+		return err
+	}
+
+	r.w, r.enc = w, json.NewEncoder(w)
+	for _, rec := range r.pending {
+		if err := r.enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	r.pending = nil
+
+	return nil
+}
+
+// SetDeviceID sets the device ID of the following records
+func (r *SessionRecorder) SetDeviceID(id string) {
+	r.mu.Lock()
+	r.deviceID = id
+	r.mu.Unlock()
+}
+
+func (r *SessionRecorder) Record(dir SessionDirection, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := SessionRecord{
+		Time:       time.Now(),
+		Direction:  dir,
+		RemoteAddr: r.remoteAddr,
+		DeviceID:   r.deviceID,
+		Data:       hex.EncodeToString(data),
+	}
+	if r.enc == nil {
+		if r.open != nil {
+			r.pending = append(r.pending, rec)
+		}
+		return nil
+	}
+
+	return r.enc.Encode(rec)
+}
+
+func (r *SessionRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = nil
+	if r.w == nil {
+		return nil
+	}
+
+	return r.w.Close()
+}
+
+// recordingConn records the data read from and written to the connection
+type recordingConn struct {
+	net.Conn
+	rec *SessionRecorder
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		_ = c.rec.Record(SessionDirectionIn, b[:n])
+	}
+
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		_ = c.rec.Record(SessionDirectionOut, b[:n])
+	}
+
+	return n, err
+}
+
+func (c *recordingConn) Close() error {
+	err := c.Conn.Close()
+	_ = c.rec.Close()
+
+	return err
+}
+
+// SessionReader reads the records of the recorded session
+type SessionReader struct {
+	dec *json.Decoder
+}
+
+func NewSessionReader(r io.Reader) *SessionReader {
+	return &SessionReader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next record, io.EOF is returned at the end of the session
+func (r *SessionReader) Next() (SessionRecord, error) {
+	var rec SessionRecord
+	err := r.dec.Decode(&rec)
+
+	return rec, err
+}
+
+// sessionReplayer streams the data received from the device
+type sessionReplayer struct {
+	r     *SessionReader
+	speed float64
+	// out is passed the data sent to the device, if set
+	out func(b []byte)
+
+	last    time.Time
+	pending []byte
+}
+
+// NewSessionReplayer returns the reader of the data received from the device in the recorded session,
+// delays between the records are divided by speed, zero speed replays without delays
+func NewSessionReplayer(r io.Reader, speed float64) io.Reader {
+	return &sessionReplayer{r: NewSessionReader(r), speed: speed}
+}
+
+// NewSessionDecoder returns the decoder of the data received from the device in the recorded session, the server
+// replies are applied to it, so the records are decoded with the bit field the server negotiated
+func NewSessionDecoder(r io.Reader, speed float64) *Decoder {
+	replayer := &sessionReplayer{r: NewSessionReader(r), speed: speed}
+	d := NewDecoder(replayer)
+	replayer.out = d.ServerReply
+
+	return d
+}
+
+func (r *sessionReplayer) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		rec, err := r.r.Next()
+		if err != nil {
+			return 0, err
+		}
+		if rec.Direction != SessionDirectionIn {
+			if r.out != nil {
+				if b, err := rec.Bytes(); err == nil {
+					r.out(b)
+				}
+			}
+			continue
+		}
+
+		if r.pending, err = rec.Bytes(); err != nil {
+			return 0, err
+		}
+
+		if r.speed > 0 && !r.last.IsZero() {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(r.last)) / r.speed))
+		}
+		r.last = rec.Time
+	}
+
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
@@ -0,0 +1,137 @@
+package ntcb
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestSessionRecordAndReplay(t *testing.T) {
+	e := NewEncoder(nil)
+
+	var session bytes.Buffer
+	rec := NewSessionRecorder(nopCloser{&session}, "127.0.0.1:50000")
+	_ = rec.Record(SessionDirectionIn, e.Handshake("100000000000000"))
+	_ = rec.Record(SessionDirectionOut, []byte("*<S"))
+	rec.SetDeviceID("100000000000000")
+	_ = rec.Record(SessionDirectionIn, e.Ping())
+
+	r := NewSessionReader(bytes.NewReader(session.Bytes()))
+	for _, expected := range []struct {
+		dir      SessionDirection
+		deviceID string
+	}{{SessionDirectionIn, ""}, {SessionDirectionOut, ""}, {SessionDirectionIn, "100000000000000"}} {
+		record, err := r.Next()
+		if err != nil || record.Direction != expected.dir || record.DeviceID != expected.deviceID || record.RemoteAddr != "127.0.0.1:50000" {
+			t.Fatalf("unexpected session record %+v, %v", record, err)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected end of session, got %v", err)
+	}
+
+	startedAt := time.Now()
+	d := NewDecoder(NewSessionReplayer(bytes.NewReader(session.Bytes()), 0))
+	for _, expected := range []FrameType{FrameTypeHandshake, FrameTypePing} {
+		if f, err := d.Decode(); err != nil || f.Type != expected {
+			t.Fatalf("unexpected frame %+v, %v", f, err)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("expected end of session, got %v", err)
+	}
+	if time.Since(startedAt) > time.Second {
+		t.Errorf("session is not replayed without delays")
+	}
+}
+
+func TestSessionDecoderServerReply(t *testing.T) {
+	ba, _ := NewBitArrayFromString(strings.Repeat("1", FlexFieldCount))
+	e := NewEncoder(ba)
+
+	var session bytes.Buffer
+	rec := NewSessionRecorder(nopCloser{&session}, "127.0.0.1:50000")
+	_ = rec.Record(SessionDirectionIn, e.Handshake("100000000000000"))
+	_ = rec.Record(SessionDirectionIn, e.ProtocolNegotiation(flexProtocolVersion20, flexProtocolVersion20, FlexFieldCount))
+	// the server falls the device back to FLEX 1.0, so it sends the records without the FLEX 2.0 fields
+	reply := append([]byte("*<FLEX"), flexProtocol, flexProtocolVersion10, flexProtocolVersion10)
+	_ = rec.Record(SessionDirectionOut, appendNTCBMessage(nil, Header{Pre: [4]byte{'@', 'N', 'T', 'C'}}, reply))
+	e.SetBitField(ba.truncate(FlexFieldCount10))
+	_ = rec.Record(SessionDirectionIn, e.Alarming(7, &RawTelemetryMessage{SeqNo: 7, CANSpeed: 0x36}))
+
+	d := NewSessionDecoder(bytes.NewReader(session.Bytes()), 0)
+	var f *Frame
+	for _, expected := range []FrameType{FrameTypeHandshake, FrameTypeProtocolNegotiation, FrameTypeTelemetry} {
+		var err error
+		if f, err = d.Decode(); err != nil || f.Type != expected {
+			t.Fatalf("unexpected frame %+v, %v", f, err)
+		}
+	}
+
+	if tm := f.TelemetryMessages[0]; tm.SeqNo != 7 || tm.CANSpeed != 0x36 {
+		t.Errorf("unexpected telemetry message, %#v", tm)
+	}
+}
+
+func TestServerSessionRecording(t *testing.T) {
+	dir := t.TempDir()
+	closed := make(chan struct{}, 2)
+	s := NewServer(ServerOptions{
+		SessionDir: dir,
+		OnConnectionClosed: func(c *Conn, err error) {
+			closed <- struct{}{}
+		},
+	})
+
+	waitClosed := func() {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("connection is not closed")
+		}
+	}
+
+	// the probe fails the handshake, so its session isn't recorded
+	serverConn, probeConn := net.Pipe()
+	defer probeConn.Close()
+	s.handleNewConnection(serverConn)
+	_, _ = probeConn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	waitClosed()
+
+	deviceConn := connectDevice(t, s)
+	for i := 0; i < 100; i++ {
+		if _, ok := s.Conn("100000000000000"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = deviceConn.Close()
+	waitClosed()
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("unexpected session files, %v", files)
+	}
+
+	f, err := os.Open(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the handshake records are kept till the file is created
+	if rec, err := NewSessionReader(f).Next(); err != nil || rec.Direction != SessionDirectionIn || rec.DeviceID != "" {
+		t.Errorf("unexpected first session record %+v, %v", rec, err)
+	}
+}
@@ -0,0 +1,122 @@
+package ntcb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats are the counters of the connection
+type ConnStats struct {
+	FramesIn  int64
+	FramesOut int64
+	BytesIn   int64
+	BytesOut  int64
+	// SkippedBytes is the garbage skipped by the stream resynchronization
+	SkippedBytes int64
+
+	FramingErrors            int64
+	ChecksumErrors           int64
+	UnsupportedVersionErrors int64
+	TruncatedErrors          int64
+	// OtherErrors are the data exchange errors other than the frame errors e.g. persistence failures
+	OtherErrors int64
+}
+
+// errorCounter returns the counter of the error, nil is returned for the errors which are not counted
+func (s *ConnStats) errorCounter(err error) *int64 {
+	switch e := err.(type) {
+	case FrameError:
+		if e.Kind.known() {
+			return frameErrorKinds[e.Kind].counter(s)
+		}
+	case DataExchangeError:
+		return &s.OtherErrors
+	}
+
+	return nil
+}
+
+// load returns the copy of the counters updated concurrently
+func (s *ConnStats) load() ConnStats {
+	return ConnStats{
+		FramesIn:                 atomic.LoadInt64(&s.FramesIn),
+		FramesOut:                atomic.LoadInt64(&s.FramesOut),
+		BytesIn:                  atomic.LoadInt64(&s.BytesIn),
+		BytesOut:                 atomic.LoadInt64(&s.BytesOut),
+		SkippedBytes:             atomic.LoadInt64(&s.SkippedBytes),
+		FramingErrors:            atomic.LoadInt64(&s.FramingErrors),
+		ChecksumErrors:           atomic.LoadInt64(&s.ChecksumErrors),
+		UnsupportedVersionErrors: atomic.LoadInt64(&s.UnsupportedVersionErrors),
+		TruncatedErrors:          atomic.LoadInt64(&s.TruncatedErrors),
+		OtherErrors:              atomic.LoadInt64(&s.OtherErrors),
+	}
+}
+
+// ConnInfo is the snapshot of the connection state
+type ConnInfo struct {
+	DeviceID    string
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	// negotiated FLEX protocol, zero until the negotiation
+	Protocol        uint8
+	ProtocolVersion uint8
+	StructVersion   uint8
+	BitField        BitArray
+
+	LastReadAt    time.Time
+	LastPingAt    time.Time
+	LastMessageAt time.Time
+
+	Stats ConnStats
+}
+
+// Info returns the snapshot of the connection state, it's safe to call concurrently with the data exchange
+func (c *Conn) Info() ConnInfo {
+	info := ConnInfo{
+		DeviceID:      c.DeviceID(),
+		RemoteAddr:    c.RemoteAddr(),
+		ConnectedAt:   c.connectedAt,
+		LastReadAt:    c.LastReadAt(),
+		LastPingAt:    c.LastPingAt(),
+		LastMessageAt: unixNano(atomic.LoadInt64(&c.lastMessageAt)),
+		Stats:         c.stats.load(),
+	}
+
+	c.stateMu.Lock()
+	info.Protocol, info.ProtocolVersion, info.StructVersion = c.proto, c.protoVersion, c.structVersion
+	info.BitField = append(BitArray(nil), c.flexBitField...)
+	c.stateMu.Unlock()
+
+	return info
+}
+
+// countRead updates the counters with the result of the frame decoding
+func (c *Conn) countRead(d *Decoder, f *Frame, err error) {
+	atomic.StoreInt64(&c.stats.BytesIn, d.BytesRead())
+	atomic.StoreInt64(&c.stats.SkippedBytes, d.Skipped())
+
+	if err != nil {
+		if counter := c.stats.errorCounter(err); counter != nil {
+			atomic.AddInt64(counter, 1)
+		}
+		if kind := errorKindLabel(err); kind != "" && c.metrics != nil {
+			c.metrics.FrameError(kind)
+		}
+		return
+	}
+
+	atomic.AddInt64(&c.stats.FramesIn, 1)
+	if c.metrics != nil {
+		c.metrics.FrameReceived(frameTypeLabel(f), len(f.Raw))
+	}
+	if f.Type == FrameTypeTelemetry || f.Type == FrameTypeExtendedTelemetry {
+		atomic.StoreInt64(&c.lastMessageAt, time.Now().UnixNano())
+	}
+}
+
+// countWrite updates the counters with the written frame
+func (c *Conn) countWrite(n int) {
+	atomic.AddInt64(&c.stats.FramesOut, 1)
+	atomic.AddInt64(&c.stats.BytesOut, int64(n))
+}
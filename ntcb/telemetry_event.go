@@ -1,10 +1,5 @@
 package ntcb
 
-import (
-	"encoding/binary"
-	"reflect"
-)
-
 type MessageType string
 
 const (
@@ -13,6 +8,13 @@ const (
 	MessageTypeCurrent  MessageType = "current"
 )
 
+// FlexFieldCount is the number of telemetry record fields defined by the FLEX 2.0 struct,
+// FLEX 1.0 struct consists of the first FlexFieldCount10 of them
+const (
+	FlexFieldCount   = 122
+	FlexFieldCount10 = 69
+)
+
 type TelemetryMessage struct {
 	Type MessageType
 	RawTelemetryMessage
@@ -88,6 +90,120 @@ type RawTelemetryMessage struct {
 	CANEngineFullWorkTimeSec     uint32
 	CANDistanceUntilService      int16
 	CANSpeed                     uint8
+
+	// FLEX 2.0
+	NavSatellites            NavSatellites
+	DOP                      DOP
+	HPNavStatus              uint8
+	HPCoordinates            HPCoordinates
+	HPAlt                    int32
+	HPDirection              uint16
+	HPSpeed                  float32
+	LBS                      LBS
+	RS485FuelSensorTemp1     int8
+	RS485FuelSensorTemp2     int8
+	RS485FuelSensorTemp3     int8
+	RS485FuelSensorTemp4     int8
+	RS485FuelSensorTemp5     int8
+	RS485FuelSensorTemp6     int8
+	RS485FuelSensor7         FuelSensor
+	RS485FuelSensor8         FuelSensor
+	RS485FuelSensor9         FuelSensor
+	RS485FuelSensor10        FuelSensor
+	RS485FuelSensor11        FuelSensor
+	RS485FuelSensor12        FuelSensor
+	RS485FuelSensor13        FuelSensor
+	RS485FuelSensor14        FuelSensor
+	RS485FuelSensor15        FuelSensor
+	RS485FuelSensor16        FuelSensor
+	TirePressureSensors1     [2]TirePressureSensor
+	TirePressureSensors2     [4]TirePressureSensor
+	TirePressureSensors3     [8]TirePressureSensor
+	TirePressureSensors4     [16]TirePressureSensor
+	TachographDriverActivity uint8
+	TachographMode           uint8
+	TachographStatus         uint16
+	TachographSpeed          uint8
+	TachographOdometer       uint32
+	TachographTimestamp      uint32
+	DisplayDriverState       uint8
+	DisplayLastMessageIndex  uint32
+	TimeIncrement            uint16
+	Acceleration             Acceleration
+	AccelerationModule       int16
+	AccelerationMax          AccelerationMax
+	PassengerCounters1       [2]uint8
+	PassengerCounters2       [2]uint8
+	PassengerCounters3       [2]uint8
+	PassengerCounters4       [2]uint8
+	PassengerCounters5       [2]uint8
+	PassengerCounters6       [2]uint8
+	PassengerCounters7       [2]uint8
+	PassengerCounters8       [2]uint8
+	AutoinformerStatus       uint8
+	LastGeofenceID           uint16
+	LastStopID               uint16
+	RouteID                  uint16
+	CameraStatus             uint8
+}
+
+type NavSatellites struct {
+	GLONASS uint8
+	GPS     uint8
+	Galileo uint8
+	Compass uint8
+	Beidou  uint8
+	DORIS   uint8
+	IRNSS   uint8
+	QZSS    uint8
+}
+
+type DOP struct {
+	HDOP uint8
+	PDOP uint8
+}
+
+type HPCoordinates struct {
+	Lat int64
+	Lon int64
+}
+
+type BaseStation struct {
+	CellID      uint32
+	LAC         uint16
+	MCC         uint16
+	MNC         uint16
+	SignalLevel uint8
+}
+
+type LBS struct {
+	Current    BaseStation
+	Neighbour1 BaseStation
+	Neighbour2 BaseStation
+	Timestamp  uint32
+}
+
+type FuelSensor struct {
+	Level uint16
+	Temp  int8
+}
+
+type TirePressureSensor struct {
+	Wheel    uint8
+	Pressure uint8
+	Temp     int8
+}
+
+type Acceleration struct {
+	X int16
+	Y int16
+	Z int16
+}
+
+type AccelerationMax struct {
+	Positive int16
+	Negative int16
+	Angular  int16
 }
 
 func (tm *RawTelemetryMessage) GetNavStatusSatelliteCount() uint8 {
@@ -130,16 +246,14 @@ func (tm *RawTelemetryMessage) GetFuelLevelLiters() float32 {
 	return 0
 }
 
-func FlexTelemetryMessageSize(ba BitArray) uint16 {
-	var te RawTelemetryMessage
-	teValue := reflect.ValueOf(te)
-
-	var dataSize uint16
-	for i := 0; i < 69; i++ {
-		if ba.IsSet(i) {
-			dataSize += uint16(binary.Size(teValue.Field(i).Interface()))
-		}
-	}
+func (tm *RawTelemetryMessage) GetHDOP() float32 {
+	return float32(tm.DOP.HDOP) / 10
+}
 
-	return dataSize
+func (tm *RawTelemetryMessage) GetPDOP() float32 {
+	return float32(tm.DOP.PDOP) / 10
+}
+
+func FlexTelemetryMessageSize(ba BitArray) uint16 {
+	return newFlexPlan(ba).size
 }
@@ -0,0 +1,72 @@
+package ntcb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrCertificateMismatch closes the connection of the device which ID doesn't match its client certificate
+var ErrCertificateMismatch = ProtocolError("device ID doesn't match the client certificate")
+
+// LoadTLSConfig loads the server certificate and key. If the client CA file is given, the devices must present
+// a certificate signed by the CA, which common name or DNS name is the device ID.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// TLSConnectionState returns the state of the TLS connection, false is returned for the plain connections
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	if c.tlsConn == nil {
+		return tls.ConnectionState{}, false
+	}
+
+	return c.tlsConn.ConnectionState(), true
+}
+
+// verifyDeviceCertificate checks the device ID against the verified client certificate, devices without
+// a certificate are left to the TLS config client auth policy
+func (c *Conn) verifyDeviceCertificate() error {
+	state, ok := c.TLSConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName == c.id {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == c.id {
+			return nil
+		}
+	}
+
+	return ErrCertificateMismatch
+}
@@ -0,0 +1,107 @@
+package ntcb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate issues the certificate with the common name, it's self-signed if the parent is nil
+func newTestCertificate(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServerTLS(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	s := NewServer(ServerOptions{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{newTestCertificate(t, "server", &ca)},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	})
+
+	tests := []struct {
+		name        string
+		cn          string
+		expectedErr error
+	}{
+		{name: "device certificate", cn: "100000000000000"},
+		{name: "certificate of another device", cn: "200000000000000", expectedErr: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, deviceConn := net.Pipe()
+			s.handleNewConnection(serverConn)
+
+			tlsConn := tls.Client(deviceConn, &tls.Config{
+				Certificates: []tls.Certificate{newTestCertificate(t, tt.cn, &ca)},
+				RootCAs:      pool,
+				ServerName:   "server",
+			})
+			defer tlsConn.Close()
+
+			if _, err := tlsConn.Write(NewEncoder(nil).Handshake("100000000000000")); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := make([]byte, ntcbHeaderSize+3)
+			_, err := io.ReadFull(tlsConn, reply)
+			if err != tt.expectedErr {
+				t.Fatalf("unexpected handshake reply %x, %v", reply, err)
+			}
+
+			if tt.expectedErr != nil {
+				return
+			}
+
+			c, ok := s.Conn("100000000000000")
+			if !ok {
+				t.Fatalf("device is not registered")
+			}
+			if state, ok := c.TLSConnectionState(); !ok || state.PeerCertificates[0].Subject.CommonName != tt.cn {
+				t.Errorf("unexpected TLS connection state %+v", state)
+			}
+		})
+	}
+}
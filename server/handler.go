@@ -0,0 +1,99 @@
+package server
+
+import (
+	"time"
+
+	"ntcb-server/ntcb"
+	"ntcb-server/service"
+
+	"github.com/rs/zerolog"
+)
+
+// storageHandler saves the device telemetry, it ends the handler chain of the server
+type storageHandler struct {
+	ntcb.NopHandler
+
+	ts      *service.TelemetryService
+	metrics *metrics
+	logger  zerolog.Logger
+}
+
+func (h *storageHandler) TelemetryMessage(c *ntcb.Conn, tm ntcb.TelemetryMessage) {
+	h.logger.Debug().
+		Str("deviceID", c.DeviceID()).
+		Str("IP", c.RemoteAddr()).
+		Msgf("telemetry data received, data=%v", tm)
+
+	if err := h.save(c, &tm); err != nil {
+		h.logger.Error().
+			Caller().
+			Err(err).
+			Str("deviceID", c.DeviceID()).
+			Str("IP", c.RemoteAddr()).
+			Msg("unable to save telemetry message")
+	}
+}
+
+func (h *storageHandler) ExtendedTelemetryMessage(c *ntcb.Conn, tm ntcb.ExtendedTelemetryMessage) {
+	h.logger.Debug().
+		Str("deviceID", c.DeviceID()).
+		Str("IP", c.RemoteAddr()).
+		Msgf("extended telemetry data received, data=%v", tm)
+
+	if err := h.saveExtended(c, &tm); err != nil {
+		h.logger.Error().
+			Caller().
+			Err(err).
+			Str("deviceID", c.DeviceID()).
+			Str("IP", c.RemoteAddr()).
+			Msg("unable to save extended telemetry message")
+	}
+}
+
+func (h *storageHandler) PersistTelemetryMessages(c *ntcb.Conn, tms []ntcb.TelemetryMessage) error {
+	for i := range tms {
+		if err := h.save(c, &tms[i]); err != nil {
+			h.logger.Error().
+				Caller().
+				Err(err).
+				Str("deviceID", c.DeviceID()).
+				Str("IP", c.RemoteAddr()).
+				Msg("unable to save telemetry message, it's left unacknowledged")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *storageHandler) PersistExtendedTelemetryMessages(c *ntcb.Conn, tms []ntcb.ExtendedTelemetryMessage) error {
+	for i := range tms {
+		if err := h.saveExtended(c, &tms[i]); err != nil {
+			h.logger.Error().
+				Caller().
+				Err(err).
+				Str("deviceID", c.DeviceID()).
+				Str("IP", c.RemoteAddr()).
+				Msg("unable to save extended telemetry message, it's left unacknowledged")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *storageHandler) save(c *ntcb.Conn, tm *ntcb.TelemetryMessage) error {
+	start := time.Now()
+	err := h.ts.Save(c.DeviceID(), c.Tags(), tm)
+	h.metrics.observeStorage("telemetry", start, err)
+
+	return err
+}
+
+func (h *storageHandler) saveExtended(c *ntcb.Conn, tm *ntcb.ExtendedTelemetryMessage) error {
+	start := time.Now()
+	err := h.ts.SaveExtended(c.DeviceID(), c.Tags(), tm)
+	h.metrics.observeStorage("extended_telemetry", start, err)
+
+	return err
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"ntcb-server/ntcb"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// listenerConfig is the listener of the config file, e.g.
+//
+//	listeners:
+//	  - name: test-firmware
+//	    address: 0.0.0.0:11001
+//	    debug: true
+//	    flex-versions: ["2.0"]
+//	    devices: ["100000000000000"]
+//	    tags: {fleet: test}
+//
+// unset debug, ack policy and TLS files default to the server ones, tls: false serves the listener without TLS
+// even if the server has TLS files
+type listenerConfig struct {
+	Name         string            `mapstructure:"name"`
+	Address      string            `mapstructure:"address"`
+	Debug        *bool             `mapstructure:"debug"`
+	TLS          *bool             `mapstructure:"tls"`
+	TLSCert      string            `mapstructure:"tls-cert"`
+	TLSKey       string            `mapstructure:"tls-key"`
+	TLSClientCA  string            `mapstructure:"tls-client-ca"`
+	FlexVersions []string          `mapstructure:"flex-versions"`
+	AckPolicy    string            `mapstructure:"ack-policy"`
+	Devices      []string          `mapstructure:"devices"`
+	Tags         map[string]string `mapstructure:"tags"`
+}
+
+// listenerProfiles reads the listeners from the config, the server listens on host and port with the server
+// options if there are none
+func listenerProfiles() ([]ntcb.ListenerProfile, error) {
+	var cfgs []listenerConfig
+	if err := viper.UnmarshalKey("listeners", &cfgs); err != nil {
+		return nil, errors.Wrap(err, "unable to read listeners")
+	}
+
+	profiles := make([]ntcb.ListenerProfile, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		p := ntcb.ListenerProfile{
+			Name:    cfg.Name,
+			Address: cfg.Address,
+			Debug:   viper.GetBool("debug"),
+			Devices: cfg.Devices,
+			Tags:    cfg.Tags,
+		}
+
+		if cfg.Debug != nil {
+			p.Debug = *cfg.Debug
+		}
+
+		ackPolicy := cfg.AckPolicy
+		if ackPolicy == "" {
+			ackPolicy = viper.GetString("ack-policy")
+		}
+		var err error
+		if p.AckPolicy, err = ntcb.ParseAckPolicy(ackPolicy); err != nil {
+			return nil, errors.Wrapf(err, "invalid ack policy of listener %s", cfg.Name)
+		}
+
+		for _, s := range cfg.FlexVersions {
+			v, err := ntcb.ParseFlexVersion(s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid FLEX version of listener %s", cfg.Name)
+			}
+			p.FlexVersions = append(p.FlexVersions, v)
+		}
+
+		// TLS files default to the server ones unless the listener sets its own or disables TLS
+		tlsEnabled := cfg.TLS == nil || *cfg.TLS
+		if tlsEnabled && cfg.TLSCert == "" {
+			cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA = viper.GetString("tls-cert"), viper.GetString("tls-key"), viper.GetString("tls-client-ca")
+		}
+		switch {
+		case !tlsEnabled:
+		case cfg.TLSCert != "":
+			if p.TLSConfig, err = ntcb.LoadTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA); err != nil {
+				return nil, errors.Wrapf(err, "unable to load TLS config of listener %s", cfg.Name)
+			}
+		case cfg.TLS != nil:
+			return nil, errors.Errorf("TLS of listener %s requires TLS files", cfg.Name)
+		}
+
+		profiles = append(profiles, p)
+	}
+
+	return profiles, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"ntcb-server/ntcb"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+// ntcbLogger writes the entries of package ntcb with zerolog
+type ntcbLogger struct {
+	logger zerolog.Logger
+	// debug entries are written for the debugged devices only, so they pass the log level
+	debug zerolog.Logger
+}
+
+func newNTCBLogger(logger zerolog.Logger) *ntcbLogger {
+	return &ntcbLogger{logger: logger, debug: logger.Level(zerolog.DebugLevel)}
+}
+
+func (l *ntcbLogger) Log(level ntcb.LogLevel, msg string, fields ...ntcb.Field) {
+	var e *zerolog.Event
+	switch level {
+	case ntcb.LevelDebug:
+		e = l.debug.Debug()
+	case ntcb.LevelInfo:
+		e = l.logger.Info()
+	case ntcb.LevelWarn:
+		e = l.logger.Warn()
+	default:
+		e = l.logger.Error()
+	}
+
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case string:
+			e = e.Str(f.Key, v)
+		case int:
+			e = e.Int(f.Key, v)
+		case []byte:
+			e = e.Hex(f.Key, v)
+		case error:
+			e = e.AnErr(f.Key, v)
+		case fmt.Stringer:
+			e = e.Str(f.Key, v.String())
+		default:
+			e = e.Interface(f.Key, v)
+		}
+	}
+
+	e.Msg(msg)
+}
+
+// watchDebugDevices toggles the debug of the devices listed in debug-devices of the config file when it changes,
+// so a device is traced without restarting the server
+func watchDebugDevices(srv *ntcb.Server, debugDevices []string, logger zerolog.Logger) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+
+	var mu sync.Mutex
+	viper.OnConfigChange(func(fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		devices := viper.GetStringSlice("debug-devices")
+		enabled := make(map[string]bool, len(devices))
+		for _, id := range devices {
+			enabled[id] = true
+			srv.SetDeviceDebug(id, true)
+		}
+		for _, id := range debugDevices {
+			if !enabled[id] {
+				srv.ResetDeviceDebug(id)
+			}
+		}
+		debugDevices = devices
+
+		logger.Info().Strs("devices", devices).Msg("debug devices are changed")
+	})
+	viper.WatchConfig()
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"ntcb-server/ntcb"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+// metrics exports the server metrics to Prometheus
+type metrics struct {
+	registry *prometheus.Registry
+
+	connections       *prometheus.CounterVec
+	closedConnections *prometheus.CounterVec
+	handshakes        *prometheus.CounterVec
+	frames            *prometheus.CounterVec
+	receivedBytes     prometheus.Counter
+	frameErrors       *prometheus.CounterVec
+	ackDuration       *prometheus.HistogramVec
+	storageDuration   *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntcb_connections_total",
+			Help: "Accepted device connections including the rejected ones.",
+		}, []string{"listener"}),
+		closedConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntcb_connections_closed_total",
+			Help: "Closed device connections by reason.",
+		}, []string{"listener", "reason"}),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntcb_handshakes_total",
+			Help: "Device handshakes by result.",
+		}, []string{"result"}),
+		frames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntcb_frames_received_total",
+			Help: "Decoded frames by type, FLEX telemetry is alarming (~T), current (~C), array (~A), extended_alarming (~X) or extended_array (~E).",
+		}, []string{"type"}),
+		receivedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ntcb_frames_received_bytes_total",
+			Help: "Bytes of the decoded frames.",
+		}),
+		frameErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntcb_frame_errors_total",
+			Help: "Frames failed to decode or handle by kind: framing, checksum, unsupported_version, truncated or data_exchange.",
+		}, []string{"kind"}),
+		ackDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ntcb_telemetry_ack_duration_seconds",
+			Help:    "Duration since the telemetry frame is read till it's acknowledged.",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"type"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ntcb_storage_duration_seconds",
+			Help:    "Duration of saving the device data by operation and result.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.connections,
+		m.closedConnections,
+		m.handshakes,
+		m.frames,
+		m.receivedBytes,
+		m.frameErrors,
+		m.ackDuration,
+		m.storageDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// registerServer exports the gauges of the server state
+func (m *metrics) registerServer(srv *ntcb.Server) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ntcb_active_connections",
+			Help: "Device connections being served.",
+		}, func() float64 {
+			return float64(srv.ActiveConns())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ntcb_connected_devices",
+			Help: "Devices passed the handshake.",
+		}, func() float64 {
+			return float64(len(srv.ActiveDeviceIDs()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ntcb_queued_telemetry_messages",
+			Help: "Telemetry messages waiting for the handlers including the spilled ones.",
+		}, func() float64 {
+			return float64(srv.QueuedMessages())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ntcb_spilled_telemetry_messages",
+			Help: "Telemetry messages waiting for the handlers in the spill files.",
+		}, func() float64 {
+			return float64(srv.SpilledMessages())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ntcb_dropped_telemetry_messages_total",
+			Help: "Telemetry messages dropped by the backpressure policy.",
+		}, func() float64 {
+			return float64(srv.DroppedMessages())
+		}),
+	)
+}
+
+func (m *metrics) ConnectionAccepted(listener string) {
+	m.connections.WithLabelValues(listener).Inc()
+}
+
+func (m *metrics) ConnectionClosed(listener string, err error) {
+	m.closedConnections.WithLabelValues(listener, closeReason(err)).Inc()
+}
+
+func (m *metrics) Handshake(err error) {
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	m.handshakes.WithLabelValues(result).Inc()
+}
+
+func (m *metrics) FrameReceived(frameType string, bytes int) {
+	m.frames.WithLabelValues(frameType).Inc()
+	m.receivedBytes.Add(float64(bytes))
+}
+
+func (m *metrics) FrameError(kind string) {
+	m.frameErrors.WithLabelValues(kind).Inc()
+}
+
+func (m *metrics) TelemetryAcknowledged(frameType string, latency time.Duration) {
+	m.ackDuration.WithLabelValues(frameType).Observe(latency.Seconds())
+}
+
+// observeStorage observes the duration of the storage operation started at the time, it's a no-op
+// if the metrics are disabled
+func (m *metrics) observeStorage(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	m.storageDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// closeReason returns the label of the connection close error, labels are few to keep the series bounded
+func closeReason(err error) string {
+	switch err := err.(type) {
+	case nil:
+		return "closed"
+	case ntcb.AdmissionError:
+		return "rejected"
+	case ntcb.TimeoutError:
+		return "timeout"
+	case ntcb.FrameError:
+		return "frame_error"
+	case *ntcb.PanicError:
+		return "panic"
+	case ntcb.ProtocolError:
+		if err == ntcb.ErrServerClosed {
+			return "shutdown"
+		}
+		return "protocol_error"
+	case net.Error:
+		if err.Timeout() {
+			return "timeout"
+		}
+	}
+
+	return "error"
+}
+
+// serveMetrics serves /metrics on the address until the context is done
+func serveMetrics(ctx context.Context, addr string, m *metrics, logger zerolog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		logger.Info().Str("address", addr).Msg("serving metrics")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error().Caller().Err(err).Msg("unable to serve metrics")
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// registrationTTL is the time the lookup result of a device is reused for
+	registrationTTL = time.Minute
+	// registrationTimeout bounds the lookup, the handshake fails once it's exceeded
+	registrationTimeout = 2 * time.Second
+	// maxRegistrations bounds the cache filled by a handshake flood of unknown devices
+	maxRegistrations = 100000
+)
+
+// registrations caches the device registration lookups, so the handshakes don't query the database every time
+type registrations struct {
+	lookup func(ctx context.Context, deviceID string) (bool, error)
+
+	mu      sync.Mutex
+	entries map[string]registration
+}
+
+type registration struct {
+	registered bool
+	expires    time.Time
+}
+
+func newRegistrations(lookup func(ctx context.Context, deviceID string) (bool, error)) *registrations {
+	return &registrations{lookup: lookup, entries: make(map[string]registration, 1024)}
+}
+
+// isRegistered returns the cached registration of the device or looks it up, the lookup errors aren't cached
+func (r *registrations) isRegistered(deviceID string) (bool, error) {
+	now := time.Now()
+
+	r.mu.Lock()
+	e, ok := r.entries[deviceID]
+	r.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.registered, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), registrationTimeout)
+	defer cancel()
+
+	registered, err := r.lookup(ctx, deviceID)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	if len(r.entries) >= maxRegistrations {
+		for id, e := range r.entries {
+			if !now.Before(e.expires) {
+				delete(r.entries, id)
+			}
+		}
+		if len(r.entries) >= maxRegistrations {
+			r.entries = make(map[string]registration, 1024)
+		}
+	}
+	r.entries[deviceID] = registration{registered: registered, expires: now.Add(registrationTTL)}
+	r.mu.Unlock()
+
+	return registered, nil
+}
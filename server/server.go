@@ -1,13 +1,22 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
 	"ntcb-server/migration"
 	"ntcb-server/ntcb"
 
 	"github.com/spf13/viper"
 )
 
-func ListenAndServe() {
+// ErrDeviceNotRegistered closes the connection of the device missing from the device table
+var ErrDeviceNotRegistered = ntcb.ProtocolError("device is not registered")
+
+// ListenAndServe serves the devices until the context is done, then shuts the server down gracefully
+func ListenAndServe(ctx context.Context) {
 	logger := NewLogger()
 
 	dsn := viper.GetString("dsn")
@@ -22,10 +31,128 @@ func ListenAndServe() {
 		logger.Fatal().Caller().Err(err).Msg("unable to create telemetry service")
 	}
 
+	ds, err := GetDeviceService()
+	if err != nil {
+		logger.Fatal().Caller().Err(err).Msg("unable to create device service")
+	}
+
+	ackPolicy, err := ntcb.ParseAckPolicy(viper.GetString("ack-policy"))
+	if err != nil {
+		logger.Fatal().Caller().Err(err).Msg("invalid ack policy")
+	}
+
+	duplicatePolicy, err := ntcb.ParseDuplicatePolicy(viper.GetString("duplicate-policy"))
+	if err != nil {
+		logger.Fatal().Caller().Err(err).Msg("invalid duplicate policy")
+	}
+
+	backpressure, err := ntcb.ParseBackpressurePolicy(viper.GetString("backpressure"))
+	if err != nil {
+		logger.Fatal().Caller().Err(err).Msg("invalid backpressure policy")
+	}
+
+	var tlsConfig *tls.Config
+	if certFile := viper.GetString("tls-cert"); certFile != "" {
+		if tlsConfig, err = ntcb.LoadTLSConfig(certFile, viper.GetString("tls-key"), viper.GetString("tls-client-ca")); err != nil {
+			logger.Fatal().Caller().Err(err).Msg("unable to load TLS config")
+		}
+	}
+
+	listeners, err := listenerProfiles()
+	if err != nil {
+		logger.Fatal().Caller().Err(err).Msg("invalid listeners")
+	}
+
+	var proxyTrustedNets []*net.IPNet
+	for _, cidr := range viper.GetStringSlice("proxy-trusted-nets") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Fatal().Caller().Err(err).Msg("invalid PROXY protocol trusted network")
+		}
+		proxyTrustedNets = append(proxyTrustedNets, ipNet)
+	}
+	if viper.GetBool("proxy-protocol") && len(proxyTrustedNets) == 0 {
+		logger.Fatal().Caller().Msg("PROXY protocol requires trusted networks, otherwise any client may forge its address")
+	}
+
+	var m *metrics
+	metricsAddr := viper.GetString("metrics-address")
+	if metricsAddr != "" {
+		m = newMetrics()
+	}
+
+	var admitDevice func(c *ntcb.Conn) error
+	if viper.GetBool("registered-devices-only") {
+		devices := newRegistrations(ds.IsRegistered)
+		admitDevice = func(c *ntcb.Conn) error {
+			registered, err := devices.isRegistered(c.DeviceID())
+			if err != nil {
+				return err
+			}
+			if !registered {
+				return ErrDeviceNotRegistered
+			}
+
+			return nil
+		}
+	}
+
 	srvOptions := ntcb.ServerOptions{
-		Address: addr,
-		Debug:   viper.GetBool("debug"),
+		Address:                  addr,
+		Logger:                   newNTCBLogger(logger),
+		Debug:                    viper.GetBool("debug"),
+		DebugDevices:             viper.GetStringSlice("debug-devices"),
+		CurrentStatePollInterval: viper.GetDuration("current-state-poll-interval"),
+		SessionDir:               viper.GetString("session-dir"),
+		Resync:                   viper.GetBool("resync"),
+		MaxGarbageBytes:          viper.GetInt("max-garbage-bytes"),
+		AckPolicy:                ackPolicy,
+		IdleTimeout:              viper.GetDuration("idle-timeout"),
+		ReadTimeout:              viper.GetDuration("read-timeout"),
+		PingTimeout:              viper.GetDuration("ping-timeout"),
+		TCPKeepAlive:             viper.GetDuration("tcp-keepalive"),
+		TLSConfig:                tlsConfig,
+		DuplicatePolicy:          duplicatePolicy,
+		ProxyProtocol:            viper.GetBool("proxy-protocol"),
+		ProxyTrustedNets:         proxyTrustedNets,
+		Listeners:                listeners,
+		MaxConns:                 viper.GetInt("max-conns"),
+		MaxConnsPerIP:            viper.GetInt("max-conns-per-ip"),
+		HandshakeRate:            viper.GetFloat64("handshake-rate"),
+		HandshakeBurst:           viper.GetInt("handshake-burst"),
+		BanThreshold:             viper.GetInt("ban-threshold"),
+		BanDuration:              viper.GetDuration("ban-duration"),
+		AdmitDevice:              admitDevice,
+		Workers:                  viper.GetInt("workers"),
+		QueueSize:                viper.GetInt("queue-size"),
+		Backpressure:             backpressure,
+		SpillDir:                 viper.GetString("spill-dir"),
+		SpillLimit:               viper.GetInt("spill-limit"),
+		OnIPBanned: func(ip string, d time.Duration) {
+			logger.Warn().
+				Str("IP", ip).
+				Dur("duration", d).
+				Msg("IP is banned for repeated protocol violations")
+		},
 		OnConnectionClosed: func(c *ntcb.Conn, err error) {
+			if err == ntcb.ErrServerClosed {
+				logger.Info().
+					Str("deviceID", c.DeviceID()).
+					Str("IP", c.RemoteAddr()).
+					Msg("connection closed on shutdown")
+				return
+			}
+
+			// rejected connections and failed handshakes are mostly scanners
+			if _, ok := err.(ntcb.AdmissionError); ok || c.DeviceID() == "" || err == ErrDeviceNotRegistered {
+				logger.Debug().
+					Err(err).
+					Str("deviceID", c.DeviceID()).
+					Str("IP", c.RemoteAddr()).
+					Msg("connection rejected")
+				return
+			}
+
 			logger.Error().
 				Caller().
 				Err(err).
@@ -33,33 +160,84 @@ func ListenAndServe() {
 				Str("IP", c.RemoteAddr()).
 				Msg("connection error has occurred")
 		},
-		OnTelemetryMessage: func(c *ntcb.Conn, tm ntcb.TelemetryMessage) {
-			logger.Debug().
+		Handler: &storageHandler{ts: ts, metrics: m, logger: logger},
+		OnDeviceInfo: func(c *ntcb.Conn, info ntcb.DeviceInfo) {
+			logger.Info().
 				Str("deviceID", c.DeviceID()).
 				Str("IP", c.RemoteAddr()).
-				Msgf("telemetry data received, data=%v", tm)
+				Str("model", info.Model).
+				Str("firmware", info.FirmwareVersion).
+				Msg("device info received")
 
-			if err := ts.Save(c.DeviceID(), &tm); err != nil {
+			start := time.Now()
+			err := ds.SaveInfo(c.DeviceID(), info)
+			m.observeStorage("device_info", start, err)
+			if err != nil {
 				logger.Error().
 					Caller().
 					Err(err).
 					Str("deviceID", c.DeviceID()).
 					Str("IP", c.RemoteAddr()).
-					Msg("unable to save telemetry message")
+					Msg("unable to save device info")
 			}
 		},
+		OnDeviceIdle: func(c *ntcb.Conn, idle time.Duration) {
+			logger.Warn().
+				Str("deviceID", c.DeviceID()).
+				Str("IP", c.RemoteAddr()).
+				Dur("idle", idle).
+				Msg("device is idle")
+		},
+		OnDeviceTimeout: func(c *ntcb.Conn, err error) {
+			logger.Warn().
+				Err(err).
+				Str("deviceID", c.DeviceID()).
+				Str("IP", c.RemoteAddr()).
+				Msg("device timed out, closing connection")
+		},
+		OnPossibleClone: func(c *ntcb.Conn, prev *ntcb.Conn) {
+			logger.Warn().
+				Str("deviceID", c.DeviceID()).
+				Str("IP", c.RemoteAddr()).
+				Str("prevIP", prev.RemoteAddr()).
+				Msg("device is connected from two IPs, IMEI may be cloned")
+		},
 		OnNewConnection: func(c *ntcb.Conn) {
 			logger.Info().
 				Str("deviceID", c.DeviceID()).
 				Str("IP", c.RemoteAddr()).
+				Str("listener", c.Listener()).
 				Msg("new connection established")
 		},
 	}
+	if m != nil {
+		srvOptions.Metrics = m
+	}
 	srv := ntcb.NewServer(srvOptions)
+	if m != nil {
+		m.registerServer(srv)
+		serveMetrics(ctx, metricsAddr, m, logger)
+	}
+	watchDebugDevices(srv, srvOptions.DebugDevices, logger)
 
-	logger.Info().Msgf("starting NTCB server at %s ", addr)
+	if len(listeners) == 0 {
+		logger.Info().Bool("TLS", tlsConfig != nil).Msgf("starting NTCB server at %s", addr)
+	}
+	// host and port are ignored once the listeners are configured
+	for _, l := range listeners {
+		logger.Info().Str("listener", l.Name).Bool("TLS", l.TLSConfig != nil).Msgf("starting NTCB listener at %s", l.Address)
+	}
 
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.ListenAndServe(ctx); err != nil {
 		logger.Fatal().Err(err).Msg("unable to start server")
 	}
+
+	logger.Info().Msg("shutting down NTCB server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown-timeout"))
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error().Err(err).Msg("server is not shut down gracefully")
+	}
 }
@@ -38,3 +38,13 @@ func GetTelemetryService() (*service.TelemetryService, error) {
 
 	return &service.TelemetryService{}, nil
 }
+
+func GetDeviceService() (*service.DeviceService, error) {
+	wire.Build(
+		NewLogger,
+		GetClickhouseGormDB,
+		service.NewDeviceService,
+	)
+
+	return &service.DeviceService{}, nil
+}
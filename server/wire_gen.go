@@ -30,6 +30,16 @@ func GetTelemetryService() (*service.TelemetryService, error) {
 	return telemetryService, nil
 }
 
+func GetDeviceService() (*service.DeviceService, error) {
+	db, err := GetClickhouseGormDB()
+	if err != nil {
+		return nil, err
+	}
+	logger := NewLogger()
+	deviceService := service.NewDeviceService(db, logger)
+	return deviceService, nil
+}
+
 // wire.go:
 
 func NewLogger() zerolog.Logger {
@@ -1,9 +1,14 @@
 package service
 
 import (
+	"context"
+	"ntcb-server/dao"
+	"ntcb-server/ntcb"
 	"ntcb-server/restmodels"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
@@ -12,7 +17,50 @@ type DeviceService struct {
 	logger zerolog.Logger
 }
 
+func NewDeviceService(db *gorm.DB, logger zerolog.Logger) *DeviceService {
+	return &DeviceService{db: db, logger: logger}
+}
+
 func (svc *DeviceService) List() ([]restmodels.Device, error) {
 
 	return nil, nil
 }
+
+// IsRegistered reports whether the device is in the device table, the rows are added by the operators
+func (svc *DeviceService) IsRegistered(ctx context.Context, deviceID string) (bool, error) {
+	var count int
+	query := "SELECT count() FROM " + dao.Device{}.TableName() + " WHERE id = ?"
+	if err := svc.db.DB().QueryRowContext(ctx, query, deviceID).Scan(&count); err != nil {
+		return false, errors.Wrap(err, "unable to count registered devices in DB")
+	}
+
+	return count > 0, nil
+}
+
+// SaveInfo updates the identification of the registered device, device table is a replacing merge tree,
+// so the latest row replaces the previous ones. The unknown device isn't added, as the table is the allowlist
+// of the registered devices.
+func (svc *DeviceService) SaveInfo(deviceID string, info ntcb.DeviceInfo) error {
+	var device dao.Device
+	err := svc.db.Where("id = ?", deviceID).Order("updated_at DESC").First(&device).Error
+	if gorm.IsRecordNotFoundError(err) {
+		svc.logger.Debug().Str("deviceID", deviceID).Msg("device info of unregistered device is not saved")
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to get device from DB")
+	}
+
+	device.Model = info.Model
+	device.FirmwareVersion = info.FirmwareVersion
+	device.FirmwareDate = info.FirmwareDate
+	device.FirmwareLanguage = info.FirmwareLanguage
+	device.ICCID = info.ICCID
+	device.UpdatedAt = time.Now()
+
+	if err := svc.db.Create(&device).Error; err != nil {
+		return errors.Wrap(err, "unable to save device to DB")
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"ntcb-server/dao"
 	"ntcb-server/ntcb"
@@ -20,11 +21,24 @@ func NewTelemetryService(db *gorm.DB, logger zerolog.Logger) *TelemetryService {
 	return &TelemetryService{db: db, logger: logger}
 }
 
-func newTelemetryMessage(deviceID string, tm *ntcb.TelemetryMessage) (*dao.TelemetryMessage, error) {
+// marshalTags returns tags of the listener as JSON, empty if there are no tags
+func marshalTags(tags map[string]string) (string, error) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+	tagsJson, err := json.Marshal(tags)
+	return string(tagsJson), err
+}
+
+func newTelemetryMessage(deviceID string, tags map[string]string, tm *ntcb.TelemetryMessage) (*dao.TelemetryMessage, error) {
 	tmJson, err := json.Marshal(tm)
 	if err != nil {
 		return nil, err
 	}
+	tagsJson, err := marshalTags(tags)
+	if err != nil {
+		return nil, err
+	}
 	return &dao.TelemetryMessage{
 		DeviceID:          deviceID,
 		SeqNo:             tm.SeqNo,
@@ -49,11 +63,13 @@ func newTelemetryMessage(deviceID string, tm *ntcb.TelemetryMessage) (*dao.Telem
 		BrakePosition:     tm.CANBrakePosition,
 		DistUntilService:  float32(tm.CANDistanceUntilService) * 5,
 		Details:           string(tmJson),
+		Tags:              tagsJson,
 	}, nil
 }
 
-func (t *TelemetryService) Save(deviceID string, message *ntcb.TelemetryMessage) error {
-	daoMsg, err := newTelemetryMessage(deviceID, message)
+// Save saves the telemetry message of the device with the tags of the listener it's connected to
+func (t *TelemetryService) Save(deviceID string, tags map[string]string, message *ntcb.TelemetryMessage) error {
+	daoMsg, err := newTelemetryMessage(deviceID, tags, message)
 	if err != nil {
 		return errors.Wrap(err, "unable to create telemetry message")
 	}
@@ -63,3 +79,53 @@ func (t *TelemetryService) Save(deviceID string, message *ntcb.TelemetryMessage)
 
 	return nil
 }
+
+func newExtendedTelemetryMessage(deviceID string, tags map[string]string, tm *ntcb.ExtendedTelemetryMessage) (*dao.ExtendedTelemetryMessage, error) {
+	tmJson, err := json.Marshal(tm)
+	if err != nil {
+		return nil, err
+	}
+	tagsJson, err := marshalTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	touchMemoryKey, _ := tm.GetTouchMemoryKey()
+	rfidCode, _ := tm.GetRFIDCode()
+	driverCard, _ := tm.GetDriverCard()
+
+	return &dao.ExtendedTelemetryMessage{
+		DeviceID:          deviceID,
+		SeqNo:             tm.SeqNo,
+		Timestamp:         time.Unix(int64(tm.Timestamp), 0),
+		EventCode:         tm.EventCode,
+		Alarming:          tm.Type == ntcb.MessageTypeExtendedAlarming,
+		NavValid:          tm.IsNavStatusValid(),
+		NavSatelliteCount: tm.GetNavStatusSatelliteCount(),
+		NavTimestamp:      time.Unix(int64(tm.LastValidNavTimestamp), 0),
+		Lon:               float64(tm.LastValidLon) / 600000.0,
+		Lat:               float64(tm.LastValidLat) / 600000.0,
+		Alt:               float64(tm.LastValidAlt) / 10.0,
+		Speed:             tm.Speed,
+		Direction:         float32(tm.Direction),
+		Odometer:          tm.Odometer,
+		TouchMemoryKey:    touchMemoryKey,
+		RFIDCode:          rfidCode,
+		DriverCard:        hex.EncodeToString(driverCard),
+		Details:           string(tmJson),
+		Tags:              tagsJson,
+	}, nil
+}
+
+// SaveExtended saves the extended telemetry message of the device with the tags of the listener it's connected to
+func (t *TelemetryService) SaveExtended(deviceID string, tags map[string]string, message *ntcb.ExtendedTelemetryMessage) error {
+	daoMsg, err := newExtendedTelemetryMessage(deviceID, tags, message)
+	if err != nil {
+		return errors.Wrap(err, "unable to create extended telemetry message")
+	}
+	if err := t.db.Save(daoMsg).Error; err != nil {
+		return errors.Wrap(err, "unable to save extended message to DB")
+	}
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package simulator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"ntcb-server/ntcb"
+)
+
+var (
+	errTimeout          = errors.New("timeout")
+	errUnexpectedReply  = errors.New("unexpected reply")
+	errConnectionClosed = errors.New("connection closed")
+	errWrite            = errors.New("write failed")
+)
+
+type device struct {
+	opts  *Options
+	imei  string
+	stats *stats
+
+	// mu guards the encoder and the last record, which are used to answer the server requests
+	mu    sync.Mutex
+	enc   *ntcb.Encoder
+	last  ntcb.RawTelemetryMessage
+	track *track
+
+	eventIndex uint32
+
+	conn    net.Conn
+	writeMu sync.Mutex
+	// replies of the server, NTCB messages and flex acks
+	replies chan []byte
+	// closed when the connection is closed by the server
+	done chan struct{}
+	// closed when the device stops
+	stop chan struct{}
+}
+
+func newDevice(opts *Options, imei string, seed int64, s *stats) *device {
+	return &device{
+		opts:    opts,
+		imei:    imei,
+		stats:   s,
+		enc:     ntcb.NewEncoder(opts.bitField()),
+		track:   newTrack(seed, opts.IgnitionCycle),
+		replies: make(chan []byte, 16),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// fail records the error, unless the simulation is over
+func (d *device) fail(ctx context.Context, stage string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	d.stats.error(stage + ": " + err.Error())
+}
+
+func (d *device) run(ctx context.Context) {
+	conn, err := net.DialTimeout("tcp", d.opts.Address, d.opts.AckTimeout)
+	if err != nil {
+		if ctx.Err() == nil {
+			d.stats.error("dial")
+		}
+		return
+	}
+	d.conn = conn
+	defer conn.Close()
+	defer close(d.stop)
+
+	// closing the connection unblocks reads and writes once the simulation is over
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-d.stop:
+		}
+	}()
+
+	go d.readLoop()
+
+	if err := d.handshake(); err != nil {
+		d.fail(ctx, "handshake", err)
+		return
+	}
+	d.stats.connected()
+
+	if err := d.negotiate(); err != nil {
+		d.fail(ctx, "negotiation", err)
+		return
+	}
+
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+
+	var ping <-chan time.Time
+	if d.opts.PingInterval > 0 {
+		pingTicker := time.NewTicker(d.opts.PingInterval)
+		defer pingTicker.Stop()
+		ping = pingTicker.C
+	}
+
+	for n := 1; ; n++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.done:
+			d.fail(ctx, "telemetry", errConnectionClosed)
+			return
+		case <-ping:
+			if err := d.write(d.enc.Ping()); err != nil {
+				d.fail(ctx, "ping", err)
+				return
+			}
+			d.stats.pingSent()
+		case <-ticker.C:
+			if err := d.sendTelemetry(n); err != nil {
+				d.fail(ctx, "telemetry", err)
+				if err == errWrite || err == errConnectionClosed {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *device) write(b []byte) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	if err := d.conn.SetWriteDeadline(time.Now().Add(d.opts.AckTimeout)); err != nil {
+		return errWrite
+	}
+	if _, err := d.conn.Write(b); err != nil {
+		return errWrite
+	}
+
+	return nil
+}
+
+// await waits for the next server reply and checks it with the expected func
+func (d *device) await(expected func(reply []byte) bool) error {
+	timer := time.NewTimer(d.opts.AckTimeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-d.replies:
+		if !expected(reply) {
+			return errUnexpectedReply
+		}
+		return nil
+	case <-d.done:
+		return errConnectionClosed
+	case <-timer.C:
+		return errTimeout
+	}
+}
+
+func ntcbReplyBody(reply []byte, prefix string) ([]byte, bool) {
+	if len(reply) < 16 || reply[0] != '@' || !bytes.HasPrefix(reply[16:], []byte(prefix)) {
+		return nil, false
+	}
+
+	return reply[16:], true
+}
+
+func (d *device) handshake() error {
+	if err := d.write(d.enc.Handshake(d.imei)); err != nil {
+		return err
+	}
+
+	return d.await(func(reply []byte) bool {
+		_, ok := ntcbReplyBody(reply, "*<S")
+		return ok
+	})
+}
+
+func (d *device) negotiate() error {
+	version := d.opts.FlexVersion
+	for {
+		if err := d.write(d.enc.ProtocolNegotiation(version, version, d.opts.dataSize())); err != nil {
+			return err
+		}
+
+		// *<FLEX + protocol (1) + protocol version (1) + struct version (1)
+		var structVersion uint8
+		if err := d.await(func(reply []byte) bool {
+			body, ok := ntcbReplyBody(reply, "*<FLEX")
+			if !ok || len(body) < 9 || body[6] != 0xb0 {
+				return false
+			}
+			structVersion = body[8]
+			return true
+		}); err != nil {
+			return err
+		}
+
+		if structVersion >= version || version == 10 {
+			return nil
+		}
+
+		// server doesn't support FLEX 2.0, fall back to the FLEX 1.0 fields
+		version = 10
+		d.mu.Lock()
+		d.enc.SetBitField(ntcb.NegotiatedBitField(d.enc.BitField(), version))
+		d.mu.Unlock()
+	}
+}
+
+func (d *device) nextRecord(dt time.Duration) ntcb.RawTelemetryMessage {
+	tm := d.track.next(dt)
+
+	d.mu.Lock()
+	d.last = tm
+	d.mu.Unlock()
+
+	return tm
+}
+
+func (d *device) sendTelemetry(n int) error {
+	var msg, ack []byte
+
+	switch {
+	case d.opts.ArrayEvery > 0 && n%d.opts.ArrayEvery == 0:
+		// records stored by the device while it was offline
+		records := make([]ntcb.RawTelemetryMessage, d.opts.ArraySize)
+		for i := range records {
+			records[i] = d.nextRecord(d.opts.Interval / time.Duration(d.opts.ArraySize))
+		}
+		msg = d.enc.Array(records)
+		ack = msg[:3]
+	case d.track.rnd.Float64() < d.opts.AlarmProbability:
+		tm := d.nextRecord(d.opts.Interval)
+		alarm(&tm)
+		d.eventIndex++
+		msg = d.enc.Alarming(d.eventIndex, &tm)
+		ack = msg[:6]
+	default:
+		tm := d.nextRecord(d.opts.Interval)
+		msg = d.enc.Array([]ntcb.RawTelemetryMessage{tm})
+		ack = msg[:3]
+	}
+	ack = append(append([]byte(nil), ack...), ntcb.CRC8(ack))
+
+	sentAt := time.Now()
+	if err := d.write(msg); err != nil {
+		return err
+	}
+	d.stats.messageSent()
+
+	if err := d.await(func(reply []byte) bool { return bytes.Equal(reply, ack) }); err != nil {
+		return err
+	}
+	d.stats.messageAcked(time.Since(sentAt))
+
+	return nil
+}
+
+func (d *device) readLoop() {
+	defer close(d.done)
+
+	r := bufio.NewReader(d.conn)
+	for {
+		frame, err := readServerFrame(r)
+		if err != nil {
+			return
+		}
+
+		if body, ok := ntcbReplyBody(frame, "*"); ok && len(body) > 1 && (body[1] == '?' || body[1] == '!') {
+			if err := d.answer(body); err != nil {
+				return
+			}
+			continue
+		}
+		if frame[0] == '~' && frame[1] == 'C' {
+			if err := d.answerCurrentState(); err != nil {
+				return
+			}
+			continue
+		}
+
+		select {
+		case d.replies <- frame:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// answer replies to the server command or request
+func (d *device) answer(cmd []byte) error {
+	d.mu.Lock()
+	var reply []byte
+	switch {
+	case bytes.Equal(cmd, ntcb.CommandVersion):
+		reply = []byte("*#V:SIM-1:01.00.00:18.10.26:EN")
+	case bytes.Equal(cmd, ntcb.CommandICCID):
+		reply = []byte("*#ICCID:8970" + d.imei)
+	case cmd[1] == '!':
+		reply = append([]byte("*@"), cmd[2:]...)
+	default:
+		reply = append([]byte("*#"), cmd[2:]...)
+	}
+	msg := d.enc.NTCBMessage(reply)
+	d.mu.Unlock()
+
+	if err := d.write(msg); err != nil {
+		return err
+	}
+	d.stats.commandAnswered()
+
+	return nil
+}
+
+// answerCurrentState replies to the server current state request with the last record
+func (d *device) answerCurrentState() error {
+	d.mu.Lock()
+	msg := d.enc.Current(&d.last)
+	d.mu.Unlock()
+
+	if err := d.write(msg); err != nil {
+		return err
+	}
+	d.stats.commandAnswered()
+
+	return nil
+}
+
+// readServerFrame reads the next NTCB message, flex ack or current state request sent by the server
+func readServerFrame(r *bufio.Reader) ([]byte, error) {
+	p, err := r.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int
+	switch {
+	case p[0] == '@':
+		h, err := r.Peek(16)
+		if err != nil {
+			return nil, err
+		}
+		size = 16 + int(binary.LittleEndian.Uint16(h[12:]))
+	case p[0] == '~' && (p[1] == 'A' || p[1] == 'E'):
+		// header (2) + count (1) + crc (1)
+		size = 4
+	case p[0] == '~' && (p[1] == 'T' || p[1] == 'X'):
+		// header (2) + event index (4) + crc (1)
+		size = 7
+	case p[0] == '~' && p[1] == 'C':
+		size = 3
+	default:
+		return nil, errUnexpectedReply
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,96 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"ntcb-server/ntcb"
+)
+
+// ReplayResult summarizes the session replayed to the server
+type ReplayResult struct {
+	Sent     int64
+	Received int64
+}
+
+// Replay sends the data received from the device in the recorded session to the server,
+// delays between the records are divided by speed, zero speed replays without delays
+func Replay(ctx context.Context, address string, session io.Reader, speed float64) (ReplayResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	var result ReplayResult
+	if result.Sent, err = io.Copy(conn, ntcb.NewSessionReplayer(session, speed)); err != nil {
+		return result, err
+	}
+
+	// server closes the connection at the end of the stream, once it's done with the replies
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+	result.Received = <-received
+
+	return result, nil
+}
+
+// Decode decodes the data received from the device in the recorded session and prints the frames
+func Decode(w io.Writer, session io.Reader, speed float64) error {
+	d := ntcb.NewSessionDecoder(session, speed)
+	for {
+		f, err := d.Decode()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if ntcb.IsNTCBDataExchangeError(err) {
+				fmt.Fprintf(w, "error: %v\n", err)
+				continue
+			}
+			return err
+		}
+
+		switch f.Type {
+		case ntcb.FrameTypeHandshake:
+			fmt.Fprintf(w, "%s: deviceID=%s\n", f.Type, f.DeviceID)
+		case ntcb.FrameTypeProtocolNegotiation:
+			fmt.Fprintf(w, "%s: protocol=%x, protocolVersion=%d, structVersion=%d, dataSize=%d, bitField=%x\n", f.Type,
+				f.Negotiation.Protocol, f.Negotiation.ProtocolVersion, f.Negotiation.StructVersion, f.Negotiation.DataSize, f.Negotiation.BitField)
+		case ntcb.FrameTypeTelemetry:
+			fmt.Fprintf(w, "%s: type=%s, eventIndex=%d, count=%d\n", f.Type, f.MessageType, f.EventIndex, len(f.TelemetryMessages))
+			for _, tm := range f.TelemetryMessages {
+				fmt.Fprintf(w, "  %+v\n", tm.RawTelemetryMessage)
+			}
+		case ntcb.FrameTypeExtendedTelemetry:
+			fmt.Fprintf(w, "%s: type=%s, eventIndex=%d, count=%d\n", f.Type, f.MessageType, f.EventIndex, len(f.ExtendedTelemetryMessages))
+			for _, tm := range f.ExtendedTelemetryMessages {
+				fmt.Fprintf(w, "  %+v\n", tm.RawExtendedTelemetryMessage)
+			}
+		case ntcb.FrameTypePing:
+			fmt.Fprintf(w, "%s\n", f.Type)
+		default:
+			fmt.Fprintf(w, "%s: %q\n", f.Type, f.Body)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ntcb-server/ntcb"
+)
+
+type Options struct {
+	// Address of the NTCB server
+	Address string
+	// Connections is the number of simulated devices
+	Connections int
+	// IMEIBase is the IMEI of the first device, the following devices get the next numbers
+	IMEIBase uint64
+	// FlexVersion is the proposed FLEX protocol and struct version, 10 or 20
+	FlexVersion uint8
+	// BitField is the proposed FLEX bit field, all fields of FlexVersion are sent if it's empty
+	BitField ntcb.BitArray
+	// Interval between telemetry messages of a device
+	Interval time.Duration
+	// PingInterval between pings of a device, zero disables pings
+	PingInterval time.Duration
+	// AlarmProbability is the probability of a telemetry message to be sent as an alarm
+	AlarmProbability float64
+	// ArrayEvery sends every n-th telemetry message as a backfill array of ArraySize records
+	ArrayEvery int
+	ArraySize  int
+	// IgnitionCycle is the duration of a trip, devices are parked for the same duration between trips
+	IgnitionCycle time.Duration
+	// AckTimeout limits waiting for the server replies
+	AckTimeout time.Duration
+	// Duration of the simulation, zero runs until the context is canceled
+	Duration time.Duration
+}
+
+func (o *Options) setDefaults() {
+	if o.Connections <= 0 {
+		o.Connections = 1
+	}
+	if o.IMEIBase == 0 {
+		o.IMEIBase = 860000000000000
+	}
+	if o.FlexVersion != 20 {
+		o.FlexVersion = 10
+	}
+	if o.Interval <= 0 {
+		o.Interval = 10 * time.Second
+	}
+	if o.ArraySize <= 0 {
+		o.ArraySize = 10
+	}
+	if o.IgnitionCycle <= 0 {
+		o.IgnitionCycle = 10 * time.Minute
+	}
+	if o.AckTimeout <= 0 {
+		o.AckTimeout = 10 * time.Second
+	}
+}
+
+// dataSize returns the number of the bit field meaningful bits
+func (o *Options) dataSize() uint8 {
+	if o.FlexVersion == 20 {
+		return ntcb.FlexFieldCount
+	}
+
+	return ntcb.FlexFieldCount10
+}
+
+func (o *Options) bitField() ntcb.BitArray {
+	if len(o.BitField) > 0 {
+		return o.BitField
+	}
+
+	ba, _ := ntcb.NewBitArrayFromString(strings.Repeat("1", int(o.dataSize())))
+	return ba
+}
+
+// Run simulates the devices until the duration is elapsed or the context is canceled
+func Run(ctx context.Context, opts Options) *Report {
+	opts.setDefaults()
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	s := &stats{errors: make(map[string]int)}
+	startedAt := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Connections; i++ {
+		d := newDevice(&opts, fmt.Sprintf("%015d", opts.IMEIBase+uint64(i)), int64(i), s)
+
+		// spread connections over the message interval
+		delay := opts.Interval * time.Duration(i) / time.Duration(opts.Connections)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			d.run(ctx)
+		}()
+	}
+
+	wg.Wait()
+
+	return s.report(opts.Connections, time.Since(startedAt))
+}
+
+type stats struct {
+	mu          sync.Mutex
+	established int
+	sent        int
+	acked       int
+	pings       int
+	commands    int
+	latencies   []time.Duration
+	errors      map[string]int
+}
+
+func (s *stats) connected() {
+	s.mu.Lock()
+	s.established++
+	s.mu.Unlock()
+}
+
+func (s *stats) messageSent() {
+	s.mu.Lock()
+	s.sent++
+	s.mu.Unlock()
+}
+
+func (s *stats) messageAcked(latency time.Duration) {
+	s.mu.Lock()
+	s.acked++
+	s.latencies = append(s.latencies, latency)
+	s.mu.Unlock()
+}
+
+func (s *stats) pingSent() {
+	s.mu.Lock()
+	s.pings++
+	s.mu.Unlock()
+}
+
+func (s *stats) commandAnswered() {
+	s.mu.Lock()
+	s.commands++
+	s.mu.Unlock()
+}
+
+func (s *stats) error(kind string) {
+	s.mu.Lock()
+	s.errors[kind]++
+	s.mu.Unlock()
+}
+
+func (s *stats) report(connections int, elapsed time.Duration) *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &Report{
+		Elapsed:     elapsed,
+		Connections: connections,
+		Established: s.established,
+		Sent:        s.sent,
+		Acked:       s.acked,
+		Pings:       s.pings,
+		Commands:    s.commands,
+		Errors:      make(map[string]int, len(s.errors)),
+	}
+	for k, v := range s.errors {
+		r.Errors[k] = v
+	}
+
+	if len(s.latencies) == 0 {
+		return r
+	}
+
+	latencies := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+
+	r.Latency = LatencyStats{
+		Min: latencies[0],
+		Avg: total / time.Duration(len(latencies)),
+		P50: percentile(50),
+		P95: percentile(95),
+		P99: percentile(99),
+		Max: latencies[len(latencies)-1],
+	}
+
+	return r
+}
+
+type LatencyStats struct {
+	Min time.Duration
+	Avg time.Duration
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Report summarizes the simulation, latencies are measured from sending a telemetry message to receiving its ack
+type Report struct {
+	Elapsed     time.Duration
+	Connections int
+	Established int
+	Sent        int
+	Acked       int
+	Pings       int
+	Commands    int
+	Latency     LatencyStats
+	// Errors is the number of errors by kind
+	Errors map[string]int
+}
+
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "elapsed:      %s\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "connections:  %d/%d established\n", r.Established, r.Connections)
+	fmt.Fprintf(w, "messages:     %d sent, %d acked\n", r.Sent, r.Acked)
+	fmt.Fprintf(w, "pings:        %d\n", r.Pings)
+	fmt.Fprintf(w, "commands:     %d answered\n", r.Commands)
+	fmt.Fprintf(w, "ack latency:  min=%s avg=%s p50=%s p95=%s p99=%s max=%s\n",
+		r.Latency.Min, r.Latency.Avg, r.Latency.P50, r.Latency.P95, r.Latency.P99, r.Latency.Max)
+
+	var total int
+	kinds := make([]string, 0, len(r.Errors))
+	for k, v := range r.Errors {
+		kinds = append(kinds, k)
+		total += v
+	}
+	sort.Strings(kinds)
+
+	fmt.Fprintf(w, "errors:       %d\n", total)
+	for _, k := range kinds {
+		fmt.Fprintf(w, "  %s: %d\n", k, r.Errors[k])
+	}
+}
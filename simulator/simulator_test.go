@@ -0,0 +1,96 @@
+package simulator
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ntcb-server/ntcb"
+)
+
+func TestRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	sessionDir := t.TempDir()
+
+	var received int64
+	srv := ntcb.NewServer(ntcb.ServerOptions{
+		Address:    addr,
+		SessionDir: sessionDir,
+		OnTelemetryMessage: func(c *ntcb.Conn, tm ntcb.TelemetryMessage) {
+			atomic.AddInt64(&received, 1)
+		},
+		OnDeviceInfo:             func(c *ntcb.Conn, info ntcb.DeviceInfo) {},
+		CurrentStatePollInterval: 100 * time.Millisecond,
+	})
+	go func() {
+		_ = srv.ListenAndServe(context.Background())
+	}()
+	defer srv.Stop()
+
+	// wait for the server to listen
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			_ = c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, version := range []uint8{10, 20} {
+		r := Run(context.Background(), Options{
+			Address:          addr,
+			Connections:      4,
+			FlexVersion:      version,
+			Interval:         20 * time.Millisecond,
+			PingInterval:     30 * time.Millisecond,
+			AlarmProbability: 0.3,
+			ArrayEvery:       3,
+			ArraySize:        5,
+			IgnitionCycle:    100 * time.Millisecond,
+			AckTimeout:       time.Second,
+			Duration:         500 * time.Millisecond,
+		})
+
+		// messages sent at the end of the simulation may be left without ack
+		if r.Established != 4 || r.Sent == 0 || r.Acked < r.Sent-r.Connections || r.Pings == 0 || r.Commands == 0 || len(r.Errors) != 0 {
+			t.Errorf("unexpected flex %d simulation report, %+v", version, r)
+		}
+	}
+
+	if atomic.LoadInt64(&received) == 0 {
+		t.Errorf("no telemetry messages received")
+	}
+
+	sessions, _ := filepath.Glob(filepath.Join(sessionDir, "*.jsonl"))
+	// sessions of the simulated devices, the server readiness probe fails the handshake and isn't recorded
+	if len(sessions) != 8 {
+		t.Fatalf("unexpected number of recorded sessions, %d", len(sessions))
+	}
+
+	f, err := os.Open(sessions[len(sessions)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := Decode(io.Discard, f, 0); err != nil {
+		t.Errorf("unexpected error decoding recorded session, %v", err)
+	}
+
+	_, _ = f.Seek(0, io.SeekStart)
+	r, err := Replay(context.Background(), addr, f, 0)
+	if err != nil || r.Sent == 0 || r.Received == 0 {
+		t.Errorf("unexpected replay result %+v, %v", r, err)
+	}
+}
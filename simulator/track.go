@@ -0,0 +1,119 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"ntcb-server/ntcb"
+)
+
+const (
+	// status bits of the telemetry record
+	statusAlarmNotification = 1 << 1
+	statusAlarm             = 1 << 2
+
+	// navigation status: valid coordinates and the number of satellites
+	navStatusValid = 1 << 1
+
+	eventCodePeriodic = 0x1000
+
+	earthRadiusKm = 6371.0
+)
+
+// track moves a vehicle around the start point, it alternates trips with the ignition on and parking
+type track struct {
+	rnd *rand.Rand
+
+	// current position in degrees
+	lat, lon float64
+	heading  float64
+	// speed in km/h
+	speed    float64
+	odometer float64
+	alt      float64
+
+	ignition      bool
+	ignitionCycle time.Duration
+	phase         time.Duration
+
+	seqNo uint32
+	at    time.Time
+}
+
+func newTrack(seed int64, ignitionCycle time.Duration) *track {
+	rnd := rand.New(rand.NewSource(seed))
+
+	return &track{
+		rnd: rnd,
+		// vehicles start around Moscow
+		lat:           55.75 + rnd.Float64()*0.2 - 0.1,
+		lon:           37.62 + rnd.Float64()*0.3 - 0.15,
+		heading:       rnd.Float64() * 360,
+		alt:           150,
+		ignition:      true,
+		ignitionCycle: ignitionCycle,
+		at:            time.Now(),
+	}
+}
+
+// next advances the track by dt and returns the telemetry record of the new position
+func (t *track) next(dt time.Duration) ntcb.RawTelemetryMessage {
+	t.at = t.at.Add(dt)
+	t.phase += dt
+	if t.phase >= t.ignitionCycle {
+		t.phase = 0
+		t.ignition = !t.ignition
+	}
+
+	if t.ignition {
+		// smooth speed and heading changes within a city
+		t.speed = math.Max(0, math.Min(90, t.speed+t.rnd.NormFloat64()*10))
+		t.heading = math.Mod(t.heading+t.rnd.NormFloat64()*15+360, 360)
+	} else {
+		t.speed = 0
+	}
+
+	distance := t.speed * dt.Hours()
+	t.odometer += distance
+	t.lat += distance / earthRadiusKm * math.Cos(t.heading*math.Pi/180) * 180 / math.Pi
+	t.lon += distance / earthRadiusKm * math.Sin(t.heading*math.Pi/180) * 180 / math.Pi / math.Cos(t.lat*math.Pi/180)
+
+	t.seqNo++
+
+	satellites := uint8(6 + t.rnd.Intn(6))
+	voltage := uint16(12100)
+	var rpm uint16
+	var ignition uint8
+	if t.ignition {
+		voltage, rpm, ignition = 13800, uint16(800+t.speed*30), 1
+	}
+
+	ts := uint32(t.at.Unix())
+
+	return ntcb.RawTelemetryMessage{
+		SeqNo:                t.seqNo,
+		EventCode:            eventCodePeriodic,
+		Timestamp:            ts,
+		GSMLevel:             uint8(10 + t.rnd.Intn(21)),
+		NavStatus:            satellites<<2 | navStatusValid,
+		LatValidNavTimestamp: ts,
+		// coordinates are in ten thousandths of a minute
+		LastValidLat:       uint32(int32(t.lat * 600000)),
+		LastValidLon:       uint32(int32(t.lon * 600000)),
+		LastValidAlt:       uint32(int32(t.alt * 10)),
+		Speed:              float32(t.speed),
+		Direction:          uint16(t.heading),
+		Odometer:           float32(t.odometer),
+		MainBatteryVoltage: voltage,
+		DiscreteSensor1:    ignition,
+		CanEngineRPM:       rpm,
+		CANSpeed:           uint8(t.speed),
+		CANOdometer:        float32(t.odometer),
+	}
+}
+
+// alarm marks the record as an alarm
+func alarm(tm *ntcb.RawTelemetryMessage) {
+	tm.Status |= statusAlarm | statusAlarmNotification
+}